@@ -0,0 +1,354 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiRequest asks the main loop to run do against the installation, so that the API never touches the
+// state of the installation from another goroutine. done is closed once do has run.
+type apiRequest struct {
+	do   func(state *WeatherMachine, current stateFn) stateFn // Runs in the main loop, returning the next state.
+	done chan bool                                            // Closed once do has run.
+}
+
+// Actuators is the current state of each output of the installation.
+type Actuators struct {
+	Smoke  byte        // The level the smoke machine is set to. (0-255)
+	Light  LightColour // The colour the light is set to, before any lightning.
+	Fan    bool        // Is the fan running?
+	Pump   bool        // Is the pump running?
+	Halted bool        // Is every output held off by the emergency stop? Smoke and Light are 0 while it is.
+}
+
+// Status is what the installation is doing, as reported by the API.
+type Status struct {
+	State       string          // The state of the installation; idle, warmup, running, finished, stopped or closed.
+	LastHRMsg   HRMsg           // The last reading from the heart rate monitor.
+	TestSession bool            // Is a test session standing in for the heart rate monitor?
+	Profile     string          // The profile the installation is running with.
+	Actuators   Actuators       // The current state of each output.
+	Water       ReservoirStatus // The water left in the reservoir.
+	Uptime      float64         // The number of seconds since the installation started.
+}
+
+// on returns true if the relay connected to pin is switched on.
+func (r *RelayControl) on(pin uint8) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.regData&(byte(0x1)<<pin) == 0
+}
+
+// status returns what the installation is doing, with the state function current.
+func status(state *WeatherMachine, current stateFn, started time.Time) Status {
+	a := Actuators{
+		Fan:    state.relayCtrl.on(state.config.I2CPinFan),
+		Pump:   state.relayCtrl.on(state.config.I2CPinPump),
+		Halted: state.dmx.isHalted(),
+	}
+
+	// Effects can keep writing to the frame buffer while it is halted, but none of it is output.
+	if !a.Halted {
+		a.Smoke = state.dmx.Channel(1)
+		a.Light = LightColour{
+			Red:    int(state.dmx.Channel(4)),
+			Green:  int(state.dmx.Channel(5)),
+			Blue:   int(state.dmx.Channel(6)),
+			Amber:  int(state.dmx.Channel(7)),
+			Dimmer: int(state.dmx.Channel(8)),
+		}
+	}
+
+	return Status{
+		State:       stateName(current),
+		LastHRMsg:   state.lastMsg,
+		TestSession: state.testing != nil,
+		Profile:     activeProfile(state.config, time.Now()),
+		Actuators:   a,
+		Water:       state.water.Status(),
+		Uptime:      time.Since(started).Seconds(),
+	}
+}
+
+// testHeartRate stands in for the heart rate monitor during a test session, sending skin contact at a
+// steady bpm on hr every second till being notified to stop on d.
+func testHeartRate(bpm int, hr chan HRMsg, d chan bool) {
+	for {
+		select {
+		case hr <- HRMsg{bpm, true}:
+		case <-d:
+			return
+		}
+
+		select {
+		case <-time.After(time.Second):
+		case <-d:
+			return
+		}
+	}
+}
+
+// startTestSession starts a session at a steady bpm, ignoring the heart rate monitor till the test
+// session is stopped.
+func startTestSession(state *WeatherMachine, current stateFn, bpm int, hr chan HRMsg) (stateFn, error) {
+	if state.halted {
+		return current, fmt.Errorf("the emergency stop is on")
+	}
+	if state.testing != nil {
+		return current, fmt.Errorf("a test session is already running")
+	}
+
+	log.Printf("INFO: Starting a test session at %d bpm", bpm)
+	state.testing = make(chan bool)
+	go testHeartRate(bpm, hr, state.testing)
+
+	return current, nil
+}
+
+// stopTestSession ends a test session, as if the participant had let go.
+func stopTestSession(state *WeatherMachine, current stateFn) (stateFn, error) {
+	if state.testing == nil {
+		return current, fmt.Errorf("no test session is running")
+	}
+
+	log.Printf("INFO: Stopping the test session")
+	cancelTestSession(state)
+
+	return current(state, state.lastMsg), nil
+}
+
+// cancelTestSession stops any test session from standing in for the heart rate monitor, leaving the
+// participant to have let go.
+func cancelTestSession(state *WeatherMachine) {
+	if state.testing == nil {
+		return
+	}
+
+	state.testing <- true
+	state.testing = nil
+	state.lastMsg = HRMsg{0, false}
+}
+
+// pulseFan runs the fan connected to the relay on pin for duration milliseconds.
+func pulseFan(pin uint8, duration int, relayCtrl *RelayControl) {
+	if err := relayCtrl.enable(pin); err != nil {
+		return
+	}
+	events.publish("fan", map[string]interface{}{"On": true})
+
+	time.Sleep(time.Millisecond * time.Duration(duration))
+
+	relayCtrl.disable(pin)
+	events.publish("fan", map[string]interface{}{"On": false})
+}
+
+// triggerEffect fires a single effect; "puff", "pulse", "pump" or "fan", using the current configuration.
+func triggerEffect(state *WeatherMachine, effect string) error {
+	if state.halted {
+		return fmt.Errorf("the emergency stop is on")
+	}
+
+	c := state.config
+	switch effect {
+	case "puff":
+		go puffSmoke(c.SmokeVolume, c.SmokeDuration, state.smoke, state.dmx)
+	case "pulse":
+		hr := state.lastMsg.HeartRate
+		if hr <= 0 {
+			hr = 60
+		}
+		go pulseLight(c, hr, fullPhase, state.dmx)
+	case "pump":
+		go pulsePump(c.I2CPinPump, c.PumpDuration, state.water, state.relayCtrl)
+	case "fan":
+		go pulseFan(c.I2CPinFan, c.FanDuration, state.relayCtrl)
+	default:
+		return fmt.Errorf("unknown effect '%s'", effect)
+	}
+
+	log.Printf("INFO: Triggered a %s", effect)
+	return nil
+}
+
+// apiServer serves the status and control API over HTTP.
+type apiServer struct {
+	requests chan apiRequest // Requests for the main loop.
+	testHR   chan HRMsg      // Heart rate readings for test sessions.
+	layers   configLayers    // Where the configuration comes from, for switching profiles.
+	started  time.Time       // The time the installation started.
+	origins  []string        // Other origins allowed to stream events.
+}
+
+// run asks the main loop to run do, waiting till it has.
+func (a *apiServer) run(do func(state *WeatherMachine, current stateFn) stateFn) {
+	r := apiRequest{do, make(chan bool)}
+	a.requests <- r
+	<-r.done
+}
+
+// reply writes v as the JSON response, or err as an error with the HTTP status code.
+func reply(w http.ResponseWriter, v interface{}, err error, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(code)
+		v = map[string]string{"Error": err.Error()}
+	}
+
+	json.NewEncoder(w).Encode(v)
+}
+
+// post wraps an action that changes the installation, refusing anything other than a POST.
+func post(action func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			reply(w, nil, fmt.Errorf("%s must be a POST", r.URL.Path), http.StatusMethodNotAllowed)
+			return
+		}
+
+		action(w, r)
+	}
+}
+
+// handler returns the routes of the API.
+//
+//	GET  /status                   what the installation is doing.
+//	GET  /config                   the configuration the installation is running with.
+//	POST /session/start?bpm=70     starts a test session, standing in for the heart rate monitor.
+//	POST /session/stop             stops the test session.
+//	POST /effect/<name>            fires a single puff, pulse, pump or fan.
+//	POST /profile?name=<name>      switches profile, or back to the schedule without a name.
+//	POST /reservoir/refilled       records that the reservoir has just been refilled.
+//	GET  /events                   a WebSocket streaming everything the installation does as it happens.
+func (a *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		var s Status
+		a.run(func(state *WeatherMachine, current stateFn) stateFn {
+			s = status(state, current, a.started)
+			return current
+		})
+		reply(w, s, nil, 0)
+	})
+
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		var c Configuration
+		a.run(func(state *WeatherMachine, current stateFn) stateFn {
+			c = state.config
+			return current
+		})
+		reply(w, c, nil, 0)
+	})
+
+	mux.HandleFunc("/session/start", post(func(w http.ResponseWriter, r *http.Request) {
+		bpm := 70
+		if b := r.URL.Query().Get("bpm"); b != "" {
+			var err error
+			if bpm, err = strconv.Atoi(b); err != nil || bpm <= 0 {
+				reply(w, nil, fmt.Errorf("'%s' is not a heart rate", b), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var err error
+		a.run(func(state *WeatherMachine, current stateFn) stateFn {
+			current, err = startTestSession(state, current, bpm, a.testHR)
+			return current
+		})
+		reply(w, map[string]int{"BPM": bpm}, err, http.StatusConflict)
+	}))
+
+	mux.HandleFunc("/session/stop", post(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		a.run(func(state *WeatherMachine, current stateFn) stateFn {
+			current, err = stopTestSession(state, current)
+			return current
+		})
+		reply(w, map[string]bool{"Stopped": true}, err, http.StatusConflict)
+	}))
+
+	mux.HandleFunc("/effect/", post(func(w http.ResponseWriter, r *http.Request) {
+		effect := strings.TrimPrefix(r.URL.Path, "/effect/")
+		if effect != "puff" && effect != "pulse" && effect != "pump" && effect != "fan" {
+			reply(w, nil, fmt.Errorf("unknown effect '%s'", effect), http.StatusNotFound)
+			return
+		}
+
+		var err error
+		a.run(func(state *WeatherMachine, current stateFn) stateFn {
+			err = triggerEffect(state, effect)
+			return current
+		})
+		reply(w, map[string]string{"Effect": effect}, err, http.StatusConflict)
+	}))
+
+	mux.HandleFunc("/profile", post(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		err := useProfile(a.layers, name)
+		reply(w, map[string]string{"Profile": name}, err, http.StatusBadRequest)
+	}))
+
+	mux.HandleFunc("/reservoir/refilled", post(func(w http.ResponseWriter, r *http.Request) {
+		var s ReservoirStatus
+		a.run(func(state *WeatherMachine, current stateFn) stateFn {
+			state.water.refilled()
+			s = state.water.Status()
+			return current
+		})
+		reply(w, s, nil, 0)
+	}))
+
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		streamEvents(events, a.origins, w, r)
+	})
+
+	return mux
+}
+
+// newHTTPServer returns a server for the handler h on address, that gives up on clients that are slow
+// to send a request, slow to read the reply or idle for too long. The event stream is unaffected, as
+// upgrading to a WebSocket clears the deadlines.
+func newHTTPServer(address string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           h,
+		ReadHeaderTimeout: time.Second * 5,
+		ReadTimeout:       time.Second * 10,
+		WriteTimeout:      time.Second * 10,
+		IdleTimeout:       time.Second * 60,
+	}
+}
+
+// serveAPI serves the status and control API on address till the program exits.
+func serveAPI(address string, a *apiServer) {
+	log.Printf("INFO: Serving the API on %s", address)
+	if err := newHTTPServer(address, a.handler()).ListenAndServe(); err != nil {
+		log.Printf("ERROR: Unable to serve the API on %s: %v", address, err)
+	}
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/kidoman/embd"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// nullBus is an I2C bus with nothing attached. Only the register writes used by the relays are
+// implemented.
+type nullBus struct {
+	embd.I2CBus
+}
+
+func (b nullBus) WriteByteToReg(addr, reg, value byte) error { return nil }
+
+// nullOutput is a DMX output that goes nowhere.
+type nullOutput struct{}
+
+func (o nullOutput) SetChannel(channel int, val byte) error { return nil }
+func (o nullOutput) Render() error                          { return nil }
+func (o nullOutput) Close() error                           { return nil }
+
+var _ = Describe("API", func() {
+	var state WeatherMachine
+	var server *httptest.Server
+	var stop chan bool
+	var testHR chan HRMsg
+	var dir string
+
+	BeforeEach(func() {
+		c := defaultConfiguration()
+		c.Reservoir.StateFile = ""
+		state = WeatherMachine{config: c, live: NewLiveConfig(c), dmx: NewFrameBuffer(nullOutput{}, 40),
+			relayCtrl: NewRelayCtrl(nullBus{}), water: NewWaterTracker(c.Reservoir, nil)}
+
+		// Stand in for the main loop.
+		requests := make(chan apiRequest)
+		stop = make(chan bool)
+		go func() {
+			update := idle
+			for {
+				select {
+				case r := <-requests:
+					update = r.do(&state, update)
+					close(r.done)
+				case <-stop:
+					return
+				}
+			}
+		}()
+
+		dir, _ = ioutil.TempDir("", "weathermachine")
+		site, _ := ioutil.ReadFile("testdata/test-config-profiles.json")
+		ioutil.WriteFile(filepath.Join(dir, "site.json"), site, 0644)
+		layers := configLayers{filepath.Join(dir, "site.json"), filepath.Join(dir, "local.json"), nil}
+
+		testHR = make(chan HRMsg)
+		server = httptest.NewServer((&apiServer{requests, testHR, layers, time.Now(), nil}).handler())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		stop <- true
+		cancelTestSession(&state)
+		os.RemoveAll(dir)
+	})
+
+	post := func(path string) int {
+		r, err := http.Post(server.URL+path, "", nil)
+		Ω(err).Should(BeNil())
+		r.Body.Close()
+		return r.StatusCode
+	}
+
+	It("should report the status of the installation", func() {
+		state.lastMsg = HRMsg{72, true}
+		state.relayCtrl.enable(state.config.I2CPinFan)
+		state.dmx.SetChannel(4, 200)
+
+		r, err := http.Get(server.URL + "/status")
+		Ω(err).Should(BeNil())
+		defer r.Body.Close()
+
+		var s Status
+		Ω(json.NewDecoder(r.Body).Decode(&s)).Should(BeNil())
+		Ω(s.State).Should(Equal("idle"))
+		Ω(s.LastHRMsg).Should(Equal(HRMsg{72, true}))
+		Ω(s.Actuators.Fan).Should(BeTrue())
+		Ω(s.Actuators.Pump).Should(BeFalse())
+		Ω(s.Actuators.Light.Red).Should(Equal(200))
+	})
+
+	It("should report the outputs as off while the emergency stop holds them", func() {
+		state.dmx.SetChannel(1, 120)
+		state.dmx.SetChannel(4, 200)
+		state.dmx.halt(true)
+
+		r, err := http.Get(server.URL + "/status")
+		Ω(err).Should(BeNil())
+		defer r.Body.Close()
+
+		var s Status
+		Ω(json.NewDecoder(r.Body).Decode(&s)).Should(BeNil())
+		Ω(s.Actuators.Halted).Should(BeTrue())
+		Ω(s.Actuators.Smoke).Should(Equal(byte(0)))
+		Ω(s.Actuators.Light).Should(Equal(LightColour{}))
+	})
+
+	It("should start and stop a test session", func() {
+		Ω(post("/session/start?bpm=fast")).Should(Equal(http.StatusBadRequest))
+		Ω(post("/session/stop")).Should(Equal(http.StatusConflict))
+
+		Ω(post("/session/start?bpm=80")).Should(Equal(http.StatusOK))
+		Eventually(testHR).Should(Receive(Equal(HRMsg{80, true})))
+		Ω(post("/session/start")).Should(Equal(http.StatusConflict))
+
+		Ω(post("/session/stop")).Should(Equal(http.StatusOK))
+		Ω(state.testing).Should(BeNil())
+		Consistently(testHR, "100ms").ShouldNot(Receive())
+	})
+
+	It("should switch profile in the local overrides file", func() {
+		Ω(post("/profile?name=outdoor")).Should(Equal(http.StatusBadRequest))
+		Ω(post("/profile?name=festival")).Should(Equal(http.StatusOK))
+
+		c, err := loadLayers(configLayers{filepath.Join(dir, "site.json"), filepath.Join(dir, "local.json"), nil})
+		Ω(err).Should(BeNil())
+		Ω(c.Profile).Should(Equal("festival"))
+		Ω(c.SmokeVolume).Should(Equal(120))
+	})
+
+	It("should only serve this machine by default, with timeouts", func() {
+		host, _, err := net.SplitHostPort(defaultConfiguration().HTTPAddress)
+		Ω(err).Should(BeNil())
+		Ω(net.ParseIP(host).IsLoopback()).Should(BeTrue())
+
+		s := newHTTPServer(defaultConfiguration().HTTPAddress, http.NotFoundHandler())
+		Ω(s.ReadHeaderTimeout).Should(BeNumerically(">", 0))
+		Ω(s.ReadTimeout).Should(BeNumerically(">", 0))
+		Ω(s.WriteTimeout).Should(BeNumerically(">", 0))
+		Ω(s.IdleTimeout).Should(BeNumerically(">", 0))
+	})
+
+	It("should only change the installation with a POST", func() {
+		r, err := http.Get(server.URL + "/effect/fan")
+		Ω(err).Should(BeNil())
+		r.Body.Close()
+		Ω(r.StatusCode).Should(Equal(http.StatusMethodNotAllowed))
+
+		r, err = http.Post(server.URL+"/effect/thunder", "", nil)
+		Ω(err).Should(BeNil())
+		r.Body.Close()
+		Ω(r.StatusCode).Should(Equal(http.StatusNotFound))
+	})
+
+	It("should record a refill of the reservoir", func() {
+		state.water = NewWaterTracker(Reservoir{Capacity: 1000, FlowRate: 10}, nil)
+		state.water.pumped(time.Minute)
+		Ω(state.water.Status().Used).Should(BeNumerically(">", 0))
+
+		r, err := http.Post(server.URL+"/reservoir/refilled", "", nil)
+		Ω(err).Should(BeNil())
+		defer r.Body.Close()
+
+		var s ReservoirStatus
+		Ω(json.NewDecoder(r.Body).Decode(&s)).Should(BeNil())
+		Ω(s.Used).Should(BeNumerically("==", 0))
+		Ω(state.water.Status().Used).Should(BeNumerically("==", 0))
+	})
+
+	It("should refuse effects while the emergency stop is on", func() {
+		state.halted = true
+
+		r, err := http.Post(server.URL+"/effect/puff", "", nil)
+		Ω(err).Should(BeNil())
+		r.Body.Close()
+		Ω(r.StatusCode).Should(Equal(http.StatusConflict))
+	})
+})
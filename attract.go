@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// flickerPattern is the frame by frame on/off pattern of a lightning flicker in attract mode.
+var flickerPattern = []bool{true, true, false, false, true, false, false, false, true}
+
+// enableAttract slowly breathes the light in the attract colour while the installation is idle, with
+// the occasional flicker of lightning to draw visitors towards it. Each frame uses the latest live
+// configuration. It only ever drives the light and stops straight away when notified on d, turning the
+// light off and then acknowledging on d, so whoever stopped it can take over the light.
+func enableAttract(live *LiveConfig, d chan bool, dmx *FrameBuffer) {
+	breath := Envelope{Curve: "gamma"}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	flicker := len(flickerPattern)
+
+	ticker := time.NewTicker(dmx.FramePeriod())
+	defer ticker.Stop()
+
+	start := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			c := live.get()
+			if c.AttractPeriod <= 0 {
+				disableLight(c, dmx) // Attract mode is disabled, just wait to be stopped.
+				continue
+			}
+
+			if flicker == len(flickerPattern) && r.Float64() < float64(c.AttractFlicker)*dmx.FramePeriod().Seconds() {
+				flicker = 0
+			}
+
+			if flicker < len(flickerPattern) {
+				if flickerPattern[flicker] {
+					enableLight(c.AttractFlash, c, dmx)
+				} else {
+					disableLight(c, dmx)
+				}
+				flicker++
+				continue
+			}
+
+			period := time.Millisecond * time.Duration(c.AttractPeriod)
+			t := float64(time.Since(start)%period) / float64(period)
+			l := c.AttractColour
+			l.Dimmer = clampChannel(float64(l.Dimmer) * breath.ease((1.0-math.Cos(2.0*math.Pi*t))/2.0))
+			enableLight(l, c, dmx)
+
+		case <-d:
+			disableLight(live.get(), dmx)
+			d <- true
+			return
+		}
+	}
+}
+
+// stopAttract stops the attract mode running on d, waiting till it has finished with the light.
+func stopAttract(d chan bool) {
+	d <- true
+	<-d
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Attract mode", func() {
+	var c Configuration
+	var fb *FrameBuffer
+	var d chan bool
+
+	BeforeEach(func() {
+		c = defaultConfiguration()
+		c.AttractColour = LightColour{10, 20, 30, 40, 200}
+		c.AttractPeriod = 100
+		c.AttractFlicker = 0
+		fb = NewFrameBuffer(nullOutput{}, 200)
+		d = make(chan bool)
+	})
+
+	It("should breathe the light in the attract colour", func() {
+		go enableAttract(NewLiveConfig(c), d, fb)
+
+		Eventually(func() byte { return fb.Channel(8) }).Should(BeNumerically(">", 100))
+		Ω(fb.Channel(4)).Should(Equal(byte(10)))
+		Ω(fb.Channel(7)).Should(Equal(byte(40)))
+
+		stopAttract(d)
+	})
+
+	It("should have finished with the light by the time it is stopped", func() {
+		go enableAttract(NewLiveConfig(c), d, fb)
+		Eventually(func() byte { return fb.Channel(8) }).Should(BeNumerically(">", 0))
+
+		stopAttract(d)
+		Ω(fb.Channel(4)).Should(Equal(byte(0)))
+		Ω(fb.Channel(8)).Should(Equal(byte(0)))
+
+		enableLight(c.S1Beat, c, fb)
+		Consistently(func() byte { return fb.Channel(8) }, "50ms").Should(Equal(byte(c.S1Beat.Dimmer)))
+	})
+
+	It("should leave the light off when attract mode is disabled", func() {
+		c.AttractPeriod = 0
+		fb.SetChannel(8, 255)
+		go enableAttract(NewLiveConfig(c), d, fb)
+
+		Eventually(func() byte { return fb.Channel(8) }).Should(Equal(byte(0)))
+		Consistently(func() byte { return fb.Channel(8) }, "50ms").Should(Equal(byte(0)))
+
+		stopAttract(d)
+	})
+})
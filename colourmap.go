@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+type ColourStop struct {
+	BPM    int         // The heart rate at which the beat is exactly this colour.
+	Colour LightColour // The colour of the beat at this heart rate.
+}
+
+// beatColours returns the colours to use for the S1 and S2 beats at the heart rate hr. Without a
+// colour map in the configuration these are S1Beat and S2Beat. With one, the S1 colour is
+// interpolated between the stops either side of hr and the S2 colour is the same mix with its
+// dimmer scaled by the ratio of the S2Beat and S1Beat dimmers, keeping the "dub" softer than the "lub".
+func beatColours(c Configuration, hr int) (s1 LightColour, s2 LightColour) {
+	if len(c.ColourMap) == 0 {
+		return c.S1Beat, c.S2Beat
+	}
+
+	s1 = colourAt(c.ColourMap, hr)
+	s2 = s1
+	if c.S1Beat.Dimmer > 0 {
+		s2.Dimmer = clampChannel(float64(s1.Dimmer) * float64(c.S2Beat.Dimmer) / float64(c.S1Beat.Dimmer))
+	}
+
+	return s1, s2
+}
+
+// colourAt interpolates the colour for the heart rate hr from the supplied stops. Heart rates outside
+// the stops take the colour of the nearest stop.
+func colourAt(stops []ColourStop, hr int) LightColour {
+	s := make([]ColourStop, len(stops))
+	copy(s, stops)
+	sort.Slice(s, func(i, j int) bool { return s[i].BPM < s[j].BPM })
+
+	i := sort.Search(len(s), func(i int) bool { return s[i].BPM >= hr })
+	switch {
+	case i == 0:
+		return s[0].Colour
+	case i == len(s):
+		return s[len(s)-1].Colour
+	case s[i].BPM == hr:
+		return s[i].Colour
+	}
+
+	a, b := s[i-1], s[i]
+	return mixColour(a.Colour, b.Colour, float64(hr-a.BPM)/float64(b.BPM-a.BPM))
+}
+
+// mixColour blends the colour a towards b by the fraction t (0-1). The red, green and blue channels
+// are blended in the Oklab colour space so that the steps between stops look even, amber and dimmer
+// have no place in that space and are blended linearly.
+func mixColour(a LightColour, b LightColour, t float64) LightColour {
+	al, aa, ab := toOklab(a.Red, a.Green, a.Blue)
+	bl, ba, bb := toOklab(b.Red, b.Green, b.Blue)
+
+	red, green, blue := fromOklab(al+(bl-al)*t, aa+(ba-aa)*t, ab+(bb-ab)*t)
+
+	return LightColour{
+		Red:    red,
+		Green:  green,
+		Blue:   blue,
+		Amber:  clampChannel(float64(a.Amber) + float64(b.Amber-a.Amber)*t),
+		Dimmer: clampChannel(float64(a.Dimmer) + float64(b.Dimmer-a.Dimmer)*t),
+	}
+}
+
+// toOklab converts a DMX colour (treated as sRGB) into Oklab lightness and chroma coordinates.
+func toOklab(red int, green int, blue int) (l float64, a float64, b float64) {
+	r, g, bl := toLinear(red), toLinear(green), toLinear(blue)
+
+	lc := math.Cbrt(0.4122214708*r + 0.5363325363*g + 0.0514459929*bl)
+	mc := math.Cbrt(0.2119034982*r + 0.6806995451*g + 0.1073969566*bl)
+	sc := math.Cbrt(0.0883024619*r + 0.2817188376*g + 0.6299787005*bl)
+
+	return 0.2104542553*lc + 0.7936177850*mc - 0.0040720468*sc,
+		1.9779984951*lc - 2.4285922050*mc + 0.4505937099*sc,
+		0.0259040371*lc + 0.7827717662*mc - 0.8086757660*sc
+}
+
+// fromOklab converts Oklab coordinates back into a DMX colour.
+func fromOklab(l float64, a float64, b float64) (red int, green int, blue int) {
+	lc := l + 0.3963377774*a + 0.2158037573*b
+	mc := l - 0.1055613458*a - 0.0638541728*b
+	sc := l - 0.0894841775*a - 1.2914855480*b
+
+	lc, mc, sc = lc*lc*lc, mc*mc*mc, sc*sc*sc
+
+	return fromLinear(+4.0767416621*lc - 3.3077115913*mc + 0.2309699292*sc),
+		fromLinear(-1.2684380046*lc + 2.6097574011*mc - 0.3413193965*sc),
+		fromLinear(-0.0041960863*lc - 0.7034186147*mc + 1.7076147010*sc)
+}
+
+// toLinear converts an sRGB channel (0-255) into linear light (0-1).
+func toLinear(v int) float64 {
+	c := float64(v) / 255.0
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// fromLinear converts linear light (0-1) into an sRGB channel (0-255).
+func fromLinear(c float64) int {
+	if c <= 0.0031308 {
+		return clampChannel(c * 12.92 * 255.0)
+	}
+
+	return clampChannel((1.055*math.Pow(c, 1.0/2.4) - 0.055) * 255.0)
+}
+
+// clampChannel rounds v to the nearest valid DMX channel value.
+func clampChannel(v float64) int {
+	return int(math.Max(0.0, math.Min(255.0, math.Floor(v+0.5))))
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Colour map", func() {
+	blue := LightColour{0, 0, 255, 0, 100}
+	amber := LightColour{255, 160, 0, 200, 150}
+	red := LightColour{255, 0, 0, 0, 250}
+	stops := []ColourStop{{120, red}, {55, blue}, {80, amber}}
+
+	Context("interpolating", func() {
+		It("should use the stop colour exactly at a stop", func() {
+			Ω(colourAt(stops, 55)).Should(Equal(blue))
+			Ω(colourAt(stops, 80)).Should(Equal(amber))
+			Ω(colourAt(stops, 120)).Should(Equal(red))
+		})
+
+		It("should clamp heart rates outside the stops", func() {
+			Ω(colourAt(stops, 30)).Should(Equal(blue))
+			Ω(colourAt(stops, 180)).Should(Equal(red))
+		})
+
+		It("should blend amber and dimmer linearly between stops", func() {
+			c := colourAt(stops, 100)
+
+			Ω(c.Amber).Should(Equal(100))
+			Ω(c.Dimmer).Should(Equal(200))
+		})
+
+		It("should round trip colours through Oklab", func() {
+			l, a, b := toOklab(200, 10, 10)
+			r, g, bl := fromOklab(l, a, b)
+
+			Ω([]int{r, g, bl}).Should(Equal([]int{200, 10, 10}))
+		})
+	})
+
+	Context("beats", func() {
+		It("should use the fixed beat colours without a colour map", func() {
+			c := Configuration{S1Beat: blue, S2Beat: red}
+			s1, s2 := beatColours(c, 90)
+
+			Ω(s1).Should(Equal(blue))
+			Ω(s2).Should(Equal(red))
+		})
+
+		It("should keep the S2 beat proportionally dimmer", func() {
+			c := Configuration{S1Beat: LightColour{Dimmer: 200}, S2Beat: LightColour{Dimmer: 100}, ColourMap: stops}
+			s1, s2 := beatColours(c, 80)
+
+			Ω(s1).Should(Equal(amber))
+			Ω(s2.Dimmer).Should(Equal(75))
+			Ω(s2.Red).Should(Equal(amber.Red))
+		})
+	})
+})
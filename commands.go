@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// runConfigCommand runs the 'config' command with the supplied arguments, returning the exit status.
+//
+//	config show              prints the site configuration file.
+//	config show --effective  prints the configuration built from every layer.
+//	config convert <from> <to>  converts a configuration file between JSON, YAML and TOML.
+func runConfigCommand(args []string, layers configLayers) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: WeatherMachine2 config show [--effective] | convert <from> <to>")
+		return 2
+	}
+
+	switch args[0] {
+	case "show":
+		fs := flag.NewFlagSet("config show", flag.ContinueOnError)
+		effective := fs.Bool("effective", false, "Show the configuration built from the defaults, site file, local overrides and environment")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+
+		if !*effective {
+			b, err := ioutil.ReadFile(layers.site)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to read '%s': %v\n", layers.site, err)
+				return 1
+			}
+			os.Stdout.Write(b)
+			return 0
+		}
+
+		c, err := loadLayers(layers)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+			return 1
+		}
+
+		b, _ := json.MarshalIndent(c, "", "\t")
+		fmt.Println(string(b))
+		return 0
+
+	case "convert":
+		if len(args) != 3 {
+			fmt.Fprintln(os.Stderr, "usage: WeatherMachine2 config convert <from> <to>")
+			return 2
+		}
+
+		if err := convertConfiguration(args[1], args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to convert '%s': %v\n", args[1], err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown config command '%s'\n", args[0])
+	return 2
+}
+
+// runProfileCommand runs the 'profile' command with the supplied arguments, returning the exit status.
+//
+//	profile list        prints each profile, marking the one that is active.
+//	profile use <name>  switches the installation to the named profile.
+//	profile schedule    switches the installation back to following the ProfileSchedule.
+func runProfileCommand(args []string, layers configLayers) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: WeatherMachine2 profile list | use <name> | schedule")
+		return 2
+	}
+
+	switch args[0] {
+	case "list":
+		c, err := loadLayers(layers)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+			return 1
+		}
+
+		active := activeProfile(c, time.Now())
+		for _, name := range profileNames(c) {
+			if name == active {
+				fmt.Printf("* %s\n", name)
+			} else {
+				fmt.Printf("  %s\n", name)
+			}
+		}
+		return 0
+
+	case "use", "schedule":
+		name := ""
+		if args[0] == "use" {
+			if len(args) != 2 {
+				fmt.Fprintln(os.Stderr, "usage: WeatherMachine2 profile use <name>")
+				return 2
+			}
+			name = args[1]
+		}
+
+		if err := useProfile(layers, name); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to switch profile: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown profile command '%s'\n", args[0])
+	return 2
+}
@@ -21,8 +21,11 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
 	"os"
+	"reflect"
+	"strings"
+	"time"
 )
 
 type LightColour struct {
@@ -34,57 +37,287 @@ type LightColour struct {
 }
 
 type Configuration struct {
-	SmokeVolume   int         // The amount of smoke for the machine to generate 0 - none, 127 - full blast.
-	DeltaTSmoke   int         // The number of milliseconds to wait before turning the smoke machine on.
-	DeltaTFan     int         // The number of milliseconds to wait before engaging the fan.
-	DeltaTPump    int         // The number of milliseconds to wait before and engaging the rain pump.
-	HRMMacAddress string      // The bluetooth peripheral ID for the heart rate monitor.
-	I2CPinFan     uint8       // The GPIO pin id to use for controlling the fan.
-	I2CPinPump    uint8       // The GPIO pin id to use for controlling the pump.
-	I2CPinLight   uint8       // The GPIO pin id to use for controlling the light.
-	SmokeAddress  string      // The serial address of the DMX controller for the smoke machine.
-	SmokeDuration int         // The number of milliseconds to activate the smoke machine.
-	FanDuration   int         // The number of milliseconds to leave the fan running.
-	BeatRate      float32     // Heartrate scale. 0.0 -> nothing. 1.0 full heartrate.
-	S1Beat        LightColour // The colour to use for the first beat of the heart.
-	S1Duration    int         // The number of milliseconds to leave the light on for the first heart beat.
-	S2Beat        LightColour // The colour to use for the second (S2) beat of the heart.
-	S2Duration    int         // The number of milliseconds to leave the light on for the second heart beat.
-	S1Pause       int         // The number of milliseconds to pause between S1 and S2.
-	SmokeInterval int         // The number of milliseconds to wait before puffing smoke.
-	PumpDuration  int         // The number of milliseconds to leave the pump running.
-	PumpInterval  int         // The number of milliseconds to wait before pumping again.
+	Version         int                        // The version of the layout of the configuration, older files are migrated when loaded.
+	SmokeVolume     int                        // The amount of smoke for the machine to generate 0 - none, 127 - full blast.
+	DeltaTSmoke     int                        // The number of milliseconds to wait before turning the smoke machine on.
+	DeltaTFan       int                        // The number of milliseconds to wait before engaging the fan.
+	DeltaTPump      int                        // The number of milliseconds to wait before and engaging the rain pump.
+	HRMMacAddress   string                     // The bluetooth peripheral ID for the heart rate monitor.
+	I2CPinFan       uint8                      // The GPIO pin id to use for controlling the fan.
+	I2CPinPump      uint8                      // The GPIO pin id to use for controlling the pump.
+	I2CPinLight     uint8                      // The GPIO pin id to use for controlling the light.
+	SmokeAddress    string                     // The serial address of the DMX controller for the smoke machine.
+	SmokeDuration   int                        // The number of milliseconds to activate the smoke machine.
+	FanDuration     int                        // The number of milliseconds to leave the fan running.
+	BeatRate        float32                    // Heartrate scale. 0.0 -> nothing. 1.0 full heartrate.
+	S1Beat          LightColour                // The colour to use for the first beat of the heart.
+	S1Duration      int                        // The number of milliseconds to hold the light at full intensity for the first heart beat.
+	S2Beat          LightColour                // The colour to use for the second (S2) beat of the heart.
+	S2Duration      int                        // The number of milliseconds to hold the light at full intensity for the second heart beat.
+	S1Pause         int                        // The number of milliseconds to pause between S1 and S2.
+	SmokeInterval   int                        // The number of milliseconds to wait before puffing smoke.
+	PumpDuration    int                        // The number of milliseconds to leave the pump running.
+	PumpInterval    int                        // The number of milliseconds to wait before pumping again.
+	OutputMode      string                     // The DMX output to use for lights and smoke; "usb" for the serial controller or "sacn".
+	SACNAddress     string                     // The host to unicast sACN frames to. Empty to multicast.
+	SACNUniverse    uint16                     // The sACN universe to send frames on. (1-63999)
+	SACNPriority    uint8                      // The sACN priority of the installation. (0-200)
+	SACNSource      string                     // The source name the installation reports to sACN receivers.
+	FrameRate       int                        // The number of times per second to refresh the DMX output.
+	S1Envelope      Envelope                   // The attack and decay of the light for the first beat of the heart.
+	S2Envelope      Envelope                   // The attack and decay of the light for the second beat of the heart.
+	ColourMap       []ColourStop               // Beat colours keyed by heart rate. Empty to always use S1Beat and S2Beat.
+	AttractColour   LightColour                // The colour of the glow that breathes while no one is touching the sensor.
+	AttractFlash    LightColour                // The colour of the lightning flickers while no one is touching the sensor.
+	AttractPeriod   int                        // The number of milliseconds for one breath of the idle glow. 0 disables attract mode.
+	AttractFlicker  float32                    // The average number of lightning flickers per second while idle.
+	Lightning       Lightning                  // The lightning strikes layered over the heartbeat while running.
+	CueFile         string                     // The JSON, YAML or TOML file describing the timeline of cues for a session. Empty for the built in timeline.
+	Storm           StormCurves                // Curves that map the heart rate onto smoke and rain intensity.
+	Phases          []Phase                    // The phases a session escalates through. Empty to run at full intensity throughout.
+	MaxSession      int                        // The number of milliseconds before a session gracefully ends. 0 for no limit.
+	SmokeBudget     SmokeBudget                // The limits on how much smoke the machine may produce.
+	Reservoir       Reservoir                  // The water reservoir that feeds the rain pump.
+	EStop           InputPin                   // The emergency stop button.
+	Profiles        map[string]json.RawMessage // Named sets of fields that override the site file, such as for a particular venue.
+	Profile         string                     // The name of the profile to run with. Empty to follow the ProfileSchedule.
+	ProfileSchedule []ProfileSlot              // The times of day to switch profile, when Profile is empty.
+	Hours           OpeningHours               // The hours the installation accepts sessions.
+	HTTPAddress     string                     // The address to serve the status and control API on, only this machine by default. Empty to switch the API off.
+	EventOrigins    []string                   // Other origins allowed to stream events, such as "http://dashboard.local", or "null" for a page opened from a file.
 }
 
-// loadConfiguration reads a JSON file from the location specified at configFile and creates a configuration
-// struct from the contents. On error a default configuration object is returned.
-func loadConfiguration(configFile string) (c Configuration, err error) {
-	c = Configuration{63, 10, 20, 30, "0", 1, 0, 2, "/dev/ttyUSB0", 500, 500, 0.9, LightColour{200, 10, 10, 50, 155}, 500, LightColour{200, 10, 10, 50, 50}, 50, 50, 1000, 500, 1000} // Create default configuration.
+// defaultConfiguration returns the configuration used for any field that is not set elsewhere.
+func defaultConfiguration() Configuration {
+	return Configuration{
+		Version: configVersion,
 
-	file, err := os.Open(configFile)
-	if err != nil {
-		return c, err
+		SmokeVolume:   63,
+		DeltaTSmoke:   10,
+		DeltaTFan:     20,
+		DeltaTPump:    30,
+		HRMMacAddress: "0",
+		I2CPinFan:     1,
+		I2CPinPump:    0,
+		I2CPinLight:   2,
+		SmokeAddress:  "/dev/ttyUSB0",
+		SmokeDuration: 500,
+		FanDuration:   500,
+		BeatRate:      0.9,
+		S1Beat:        LightColour{Red: 200, Green: 10, Blue: 10, Amber: 50, Dimmer: 155},
+		S1Duration:    500,
+		S2Beat:        LightColour{Red: 200, Green: 10, Blue: 10, Amber: 50, Dimmer: 50},
+		S2Duration:    50,
+		S1Pause:       50,
+		SmokeInterval: 1000,
+		PumpDuration:  500,
+		PumpInterval:  1000,
+
+		OutputMode:   "usb",
+		SACNAddress:  "",
+		SACNUniverse: 1,
+		SACNPriority: 100,
+		SACNSource:   "WeatherMachine2",
+		FrameRate:    40,
+
+		S1Envelope: Envelope{Attack: 0, Decay: 0, Curve: "linear"},
+		S2Envelope: Envelope{Attack: 0, Decay: 0, Curve: "linear"},
+		ColourMap:  nil,
+
+		AttractColour:  LightColour{Red: 10, Green: 10, Blue: 200, Amber: 0, Dimmer: 60},
+		AttractFlash:   LightColour{Red: 200, Green: 200, Blue: 255, Amber: 0, Dimmer: 255},
+		AttractPeriod:  6000,
+		AttractFlicker: 0.02,
+
+		Lightning: Lightning{Density: 0, Intensity: 255, Temperature: 6500, MinFlashes: 1, MaxFlashes: 4, Seed: 0, SpikeBPM: 0},
+
+		CueFile:    "",
+		Storm:      StormCurves{TrendWindow: 10000, TrendGain: 0.0},
+		Phases:     nil,
+		MaxSession: 0,
+
+		SmokeBudget: SmokeBudget{Window: 60000, MaxOn: 30000, MinGap: 250, SessionCap: 0},
+		Reservoir:   Reservoir{Capacity: 0, FlowRate: 0, RefillLevel: 0, StateFile: "WeatherMachine2.water"},
+		EStop:       InputPin{},
+
+		Profiles:        nil,
+		Profile:         "",
+		ProfileSchedule: nil,
+
+		Hours: OpeningHours{Weekly: nil, Exceptions: nil, PurgeDuration: 30000, AttractBefore: 0},
+
+		HTTPAddress: "127.0.0.1:8080",
+	}
+}
+
+// configLayers are the sources a configuration is built from. Each layer only needs to set the fields
+// it cares about, overriding the same fields in the layers before it.
+type configLayers struct {
+	site  string   // The site configuration file, layered over the defaults.
+	local string   // The local overrides file, layered over the site file. Optional.
+	env   []string // Environment variables in the form "WM_FIELD_SUBFIELD=value", layered over everything.
+}
+
+// decodeLayer parses the JSON configuration b over the top of c, leaving any fields b does not mention
+// untouched. Unknown fields are errors.
+func decodeLayer(b []byte, c *Configuration) error {
+	if unknown := unknownFields(b, reflect.TypeOf(*c), ""); len(unknown) > 0 {
+		e := ConfigErrors{}
+		for _, u := range unknown {
+			e.add(u, "unknown field")
+		}
+		return e
+	}
+
+	return json.Unmarshal(b, c)
+}
+
+// envLayer converts the WM_ environment variables in env into a JSON configuration layer. The name of
+// each variable is the path to the field, separated by underscores and ignoring case, such as
+// WM_SMOKEVOLUME=80 or WM_S1BEAT_RED=255.
+func envLayer(env []string) ([]byte, error) {
+	layer := map[string]interface{}{}
+	e := ConfigErrors{}
+
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, "WM_") {
+			continue
+		}
+
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		name, value := kv[:i], kv[i+1:]
+
+		// Walk down the configuration to the field named by the variable.
+		t := reflect.TypeOf(Configuration{})
+		m := layer
+		path := strings.Split(name[3:], "_")
+		if renamed, ok := migrateName(path[0]); ok {
+			noteMigration(name, []string{fmt.Sprintf("%s is now %s", path[0], renamed)})
+			path[0] = renamed
+		}
+		for j, part := range path {
+			if t.Kind() != reflect.Struct {
+				e.add(name, "unknown field")
+				break
+			}
+
+			f, ok := t.FieldByNameFunc(func(n string) bool { return strings.EqualFold(n, part) })
+			if !ok {
+				e.add(name, "unknown field")
+				break
+			}
+			t = f.Type
+
+			if j < len(path)-1 {
+				if _, ok := m[f.Name].(map[string]interface{}); !ok {
+					m[f.Name] = map[string]interface{}{}
+				}
+				m = m[f.Name].(map[string]interface{})
+				continue
+			}
+
+			// Strings are taken as they are, anything else is parsed as JSON.
+			var v interface{} = value
+			if t.Kind() != reflect.String {
+				if err := json.Unmarshal([]byte(value), &v); err != nil {
+					e.add(name, "unable to parse '%s'", value)
+				}
+			}
+			m[f.Name] = v
+		}
+	}
+
+	if len(e) > 0 {
+		return nil, e
 	}
-	defer file.Close()
+	return json.Marshal(layer)
+}
 
-	// Parse JSON from the configuration file.
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&c)
-	return c, err
+// mergeLayers decodes each JSON layer over the defaults in turn. Empty layers are skipped.
+func mergeLayers(layers ...[]byte) (c Configuration, err error) {
+	c = defaultConfiguration()
+
+	for _, b := range layers {
+		if len(b) == 0 {
+			continue
+		}
+		if err = decodeLayer(b, &c); err != nil {
+			return c, err
+		}
+	}
+
+	return c, nil
 }
 
-func saveConfiguration(configFile string, c Configuration) {
-	// Save the default configuration file to disk for use later.
-	file, err := os.Create(configFile)
+// loadLayers builds a configuration from the defaults, the site file, the active profile, the local
+// overrides file and the environment, in that order. Each file can be JSON, YAML or TOML, chosen by its
+// extension. A missing local overrides file is ignored. A missing site file is reported, but the
+// remaining layers are still applied. On any other error a default configuration object is returned.
+func loadLayers(l configLayers) (c Configuration, err error) {
+	defaults := defaultConfiguration()
+
+	site, siteErr := readLayer(l.site)
+	if siteErr != nil && !os.IsNotExist(siteErr) {
+		return defaults, siteErr
+	}
+
+	var local []byte
+	if l.local != "" {
+		local, err = readLayer(l.local)
+		if err != nil && !os.IsNotExist(err) {
+			return defaults, err
+		}
+	}
+
+	env, err := envLayer(l.env)
 	if err != nil {
-		return
+		return defaults, err
+	}
+
+	if c, err = mergeLayers(site, local, env); err != nil {
+		return defaults, err
+	}
+
+	// The profile sits between the site file and the local overrides, so the overrides still win.
+	name := activeProfile(c, time.Now())
+	if profile, ok := c.Profiles[name]; ok {
+		profile, applied := migrate(profile)
+		noteMigration(l.site+" profile "+name, applied)
+		if c, err = mergeLayers(site, profile, local, env); err != nil {
+			return defaults, err
+		}
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	err = encoder.Encode(&c)
+	if err = validateConfiguration(c); err != nil {
+		return defaults, err
+	}
+
+	return c, siteErr
+}
+
+// loadConfiguration reads a JSON, YAML or TOML file from the location specified at configFile and creates
+// a configuration struct from the contents. Fields missing from the file keep their default values, while
+// unknown fields and invalid values are errors. On error a default configuration object is returned.
+func loadConfiguration(configFile string) (c Configuration, err error) {
+	c = defaultConfiguration()
+
+	b, err := readLayer(configFile)
 	if err != nil {
-		log.Printf("ERROR: Unable to encode configuration file")
+		return c, err
 	}
-	log.Printf("INFO: Saved configuration file")
+
+	// Parse the configuration file, already converted to JSON.
+	loaded := c
+	if err = decodeLayer(b, &loaded); err != nil {
+		return c, err
+	}
+
+	if err = validateConfiguration(loaded); err != nil {
+		return c, err
+	}
+
+	return loaded, nil
 }
@@ -20,9 +20,18 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestConfiguration(t *testing.T) {
@@ -41,8 +50,8 @@ var _ = Describe("Configuration", func() {
 			Ω(c.DeltaTFan).Should(Equal(20))
 			Ω(c.DeltaTPump).Should(Equal(30))
 			Ω(c.HRMMacAddress).Should(Equal("0"))
-			Ω(c.GPIOPinFan).Should(Equal(16))
-			Ω(c.GPIOPinPump).Should(Equal(20))
+			Ω(c.I2CPinFan).Should(Equal(uint8(1)))
+			Ω(c.I2CPinPump).Should(Equal(uint8(0)))
 		})
 
 		It("should be able to load a valid config file", func() {
@@ -54,10 +63,460 @@ var _ = Describe("Configuration", func() {
 			Ω(c.DeltaTFan).Should(Equal(30))
 			Ω(c.DeltaTPump).Should(Equal(60))
 			Ω(c.HRMMacAddress).Should(Equal("FF:FF:FF:FF:FF:FF"))
-			Ω(c.GPIOPinFan).Should(Equal(1))
-			Ω(c.GPIOPinPump).Should(Equal(2))
+			Ω(c.I2CPinFan).Should(Equal(uint8(1)))
+			Ω(c.I2CPinPump).Should(Equal(uint8(2)))
 			Ω(c.BeatRate).Should(BeNumerically("~", 0.8, 0.001))
 			Ω(c.S1Beat.Red).Should(Equal(100))
 		})
 	})
+
+	Context("formats", func() {
+		It("should load YAML and TOML the same as JSON", func() {
+			j, err := loadConfiguration("testdata/test-config.json")
+			Ω(err).Should(BeNil())
+
+			y, err := loadConfiguration("testdata/test-config.yaml")
+			Ω(err).Should(BeNil())
+			Ω(y).Should(Equal(j))
+
+			t, err := loadConfiguration("testdata/test-config.toml")
+			Ω(err).Should(BeNil())
+			Ω(t).Should(Equal(j))
+		})
+
+		It("should convert between formats", func() {
+			dir, _ := ioutil.TempDir("", "weathermachine")
+			defer os.RemoveAll(dir)
+			j, _ := loadConfiguration("testdata/test-config.json")
+
+			for _, to := range []string{"converted.toml", "converted.yaml", "converted.json"} {
+				Ω(convertConfiguration("testdata/test-config.yaml", filepath.Join(dir, to))).Should(BeNil())
+
+				c, err := loadConfiguration(filepath.Join(dir, to))
+				Ω(err).Should(BeNil())
+				Ω(c).Should(Equal(j))
+			}
+
+			Ω(convertConfiguration("testdata/test-config.json", filepath.Join(dir, "converted.yaml"))).ShouldNot(BeNil())
+			Ω(convertConfiguration("testdata/unknown-config.json", filepath.Join(dir, "unknown.yaml"))).ShouldNot(BeNil())
+		})
+	})
+
+	Context("migrating", func() {
+		It("should load every historical layout of the configuration the same", func() {
+			current, err := loadConfiguration("testdata/test-config-v1.json")
+			Ω(err).Should(BeNil())
+			Ω(current.Version).Should(Equal(1))
+			Ω(current.I2CPinPump).Should(Equal(uint8(2)))
+			Ω(current.I2CPinLight).Should(Equal(uint8(3)))
+
+			// The site file the installation shipped with, before the configuration had a Version.
+			c, err := loadConfiguration("testdata/test-config.json")
+			Ω(err).Should(BeNil())
+			Ω(c).Should(Equal(current))
+		})
+
+		It("should prefer the new name of a field when a file has both", func() {
+			b, applied := migrate([]byte(`{"GPIOPinPump":2,"I2CPinPump":4}`))
+
+			Ω(string(b)).Should(Equal(`{"I2CPinPump":4,"Version":1}`))
+			Ω(applied).Should(HaveLen(1))
+		})
+
+		It("should leave current files alone and reject files from the future", func() {
+			b := []byte(`{"Version":1,"GPIOPinPump":2}`)
+			migrated, applied := migrate(b)
+			Ω(migrated).Should(Equal(b))
+			Ω(applied).Should(BeEmpty())
+
+			b = []byte(`{"SmokeVolume":40}`)
+			migrated, applied = migrate(b)
+			Ω(migrated).Should(Equal(b))
+			Ω(applied).Should(BeEmpty())
+
+			c := defaultConfiguration()
+			c.Version = 2
+			Ω(validateConfiguration(c)).Should(Equal(ConfigErrors{"Version: 2 is newer than the latest version this installation understands, 1"}))
+		})
+		It("should note an older layout once, and only log migrations that write a file", func() {
+			var logged bytes.Buffer
+			log.SetOutput(&logged)
+			defer log.SetOutput(os.Stderr)
+
+			dir, _ := ioutil.TempDir("", "weathermachine")
+			defer os.RemoveAll(dir)
+			file := filepath.Join(dir, "old.json")
+			ioutil.WriteFile(file, []byte("{\n\t\"GPIOPinPump\":2,\n\t\"HRMMacAddress\":\"0\"\n}\n"), 0644)
+
+			c, err := loadConfiguration(file)
+			Ω(err).Should(BeNil())
+			Ω(c.I2CPinPump).Should(Equal(uint8(2)))
+			loadConfiguration(file)
+			Ω(strings.Count(logged.String(), "older layout")).Should(Equal(1))
+
+			c.HRMMacAddress = "00:11:22:33:44:55"
+			Ω(saveConfiguration(file, c)).Should(BeNil())
+			Ω(logged.String()).ShouldNot(ContainSubstring("Migrated"))
+
+			Ω(convertConfiguration(file, filepath.Join(dir, "new.yaml"))).Should(BeNil())
+			Ω(logged.String()).Should(ContainSubstring("Migrated"))
+		})
+
+		It("should migrate profiles and environment variables that use older names", func() {
+			dir, _ := ioutil.TempDir("", "weathermachine")
+			defer os.RemoveAll(dir)
+			file := filepath.Join(dir, "profiles.json")
+			ioutil.WriteFile(file, []byte(`{"Profile":"old","Profiles":{"old":{"GPIOPinPump":7}}}`), 0644)
+
+			c, err := loadLayers(configLayers{file, "", []string{"WM_GPIOPINFAN=6"}})
+			Ω(err).Should(BeNil())
+			Ω(c.I2CPinPump).Should(Equal(uint8(7)))
+			Ω(c.I2CPinFan).Should(Equal(uint8(6)))
+			Ω(validateConfiguration(c)).Should(BeNil())
+		})
+	})
+
+	Context("layering", func() {
+		It("should merge each layer over the one before it, field by field", func() {
+			c, err := loadLayers(configLayers{"testdata/test-config.json", "testdata/test-config.local.json", []string{
+				"HOME=/root",
+				"WM_DELTATPUMP=90",
+				"WM_S1Beat_Green=30",
+				"WM_HRMMACADDRESS=00:11:22:33:44:55",
+			}})
+
+			Ω(err).Should(BeNil())
+			Ω(c.SmokeVolume).Should(Equal(80))                           // Local overrides.
+			Ω(c.DeltaTSmoke).Should(Equal(20))                           // Site file.
+			Ω(c.DeltaTPump).Should(Equal(90))                            // Environment.
+			Ω(c.S1Pause).Should(Equal(50))                               // Defaults.
+			Ω(c.S1Beat).Should(Equal(LightColour{100, 30, 200, 15, 15})) // All three.
+			Ω(c.HRMMacAddress).Should(Equal("00:11:22:33:44:55"))
+		})
+
+		It("should apply the other layers without a site file", func() {
+			c, err := loadLayers(configLayers{"foo", "bar", []string{"WM_SMOKEVOLUME=100"}})
+
+			Ω(os.IsNotExist(err)).Should(BeTrue())
+			Ω(c.SmokeVolume).Should(Equal(100))
+			Ω(c.DeltaTSmoke).Should(Equal(10))
+		})
+
+		It("should reject unknown environment variables", func() {
+			c, err := loadLayers(configLayers{"testdata/test-config.json", "", []string{"WM_SMOKEVOLUMES=100", "WM_S1BEAT_RED=lots"}})
+
+			Ω(err).Should(Equal(ConfigErrors{
+				"WM_SMOKEVOLUMES: unknown field",
+				"WM_S1BEAT_RED: unable to parse 'lots'",
+			}))
+			Ω(c).Should(Equal(defaultConfiguration()))
+		})
+	})
+
+	Context("reloading", func() {
+		It("should describe each changed field", func() {
+			a := defaultConfiguration()
+			b := defaultConfiguration()
+			b.SmokeVolume = 80
+			b.S1Beat.Red = 255
+			b.ColourMap = []ColourStop{{55, LightColour{Blue: 255}}}
+
+			Ω(diffConfiguration(a, b)).Should(Equal([]string{
+				"SmokeVolume: 63 -> 80",
+				"S1Beat.Red: 200 -> 255",
+				`ColourMap: null -> [{"BPM":55,"Colour":{"Red":0,"Green":0,"Blue":255,"Amber":0,"Dimmer":0}}]`,
+			}))
+			Ω(diffConfiguration(a, a)).Should(BeEmpty())
+		})
+
+		It("should only pass on valid configurations that have changed", func() {
+			c := make(chan Configuration, 1)
+			current, _ := loadConfiguration("testdata/test-config.json")
+			r := &configReloader{layers: configLayers{site: "testdata/test-config.json"}, current: current}
+
+			r.check(c)
+			Ω(c).ShouldNot(Receive()) // Same configuration, just not checked before.
+
+			r.layers.site = "testdata/invalid-config.json"
+			r.check(c)
+			Ω(c).ShouldNot(Receive())
+			Ω(r.current).Should(Equal(current))
+
+			r.layers.site = "foo"
+			r.check(c)
+			Ω(c).ShouldNot(Receive())
+			Ω(r.current).Should(Equal(current))
+		})
+	})
+
+	Context("validation", func() {
+		It("should accept the default configuration", func() {
+			c, _ := loadConfiguration("foo")
+
+			Ω(validateConfiguration(c)).Should(BeNil())
+		})
+
+		It("should report every invalid field by its path", func() {
+			c, err := loadConfiguration("testdata/invalid-config.json")
+
+			Ω(err).Should(BeAssignableToTypeOf(ConfigErrors{}))
+			Ω(err.(ConfigErrors)).Should(ConsistOf(
+				"SmokeVolume: 300 is outside 0-255",
+				"DeltaTSmoke: -20 must be at least 0",
+				"I2CPinFan: 9 is outside 0-7",
+				"BeatRate: 0 must be greater than 0",
+				"S1Beat.Blue: -1 is outside 0-255",
+				"S2Duration: -100 must be at least 0",
+			))
+			Ω(c.SmokeVolume).Should(Equal(63))
+		})
+
+		It("should reject unknown fields", func() {
+			c, err := loadConfiguration("testdata/unknown-config.json")
+
+			Ω(err).Should(BeAssignableToTypeOf(ConfigErrors{}))
+			Ω(err.(ConfigErrors)).Should(Equal(ConfigErrors{
+				"I2CPinFans: unknown field",
+				"S1Beat.Brightness: unknown field",
+			}))
+			Ω(c.SmokeVolume).Should(Equal(63))
+		})
+
+		It("should check the cues in a cue file", func() {
+			c, _ := loadConfiguration("foo")
+			c.CueFile = "testdata/test-cues.json"
+			Ω(validateConfiguration(c)).Should(BeNil())
+
+			c.CueFile = "testdata/missing-cues.json"
+			Ω(validateConfiguration(c)).ShouldNot(BeNil())
+		})
+	})
+
+	Context("mid-session changes", func() {
+		It("should apply everything outside of a session", func() {
+			c := defaultConfiguration()
+			state := WeatherMachine{config: c, live: NewLiveConfig(c), smoke: NewSmokeGovernor(c.SmokeBudget)}
+
+			n := c
+			n.S1Beat.Red = 10
+			n.I2CPinFan = 4
+			applyConfiguration(&state, n)
+
+			Ω(state.config).Should(Equal(n))
+			Ω(state.live.get()).Should(Equal(n))
+			Ω(state.pending).Should(BeNil())
+		})
+
+		It("should only apply live fields during a session, holding the rest till it ends", func() {
+			c := defaultConfiguration()
+			state := WeatherMachine{config: c, live: NewLiveConfig(c), smoke: NewSmokeGovernor(c.SmokeBudget), inSession: true}
+
+			n := c
+			n.S1Beat.Red = 10
+			n.I2CPinFan = 4
+			n.FanDuration = 9000
+			applyConfiguration(&state, n)
+
+			Ω(state.live.get().S1Beat.Red).Should(Equal(10))
+			Ω(state.live.get().I2CPinFan).Should(Equal(uint8(1)))
+			Ω(state.config.FanDuration).Should(Equal(500))
+
+			sessionEnded(&state)
+			Ω(state.inSession).Should(BeFalse())
+			Ω(state.live.get()).Should(Equal(n))
+			Ω(state.pending).Should(BeNil())
+		})
+
+		It("should change the smoke budget, and hold on to fields that need a restart", func() {
+			c := defaultConfiguration()
+			state := WeatherMachine{config: c, live: NewLiveConfig(c), smoke: NewSmokeGovernor(c.SmokeBudget)}
+
+			n := c
+			n.SmokeBudget.MaxOn = 1000
+			n.SACNAddress = "10.0.0.5"
+			n.Reservoir.Capacity = 50
+			applyConfiguration(&state, n)
+
+			Ω(state.smoke.budget.MaxOn).Should(Equal(1000))
+			Ω(state.config.SmokeBudget.MaxOn).Should(Equal(1000))
+			Ω(state.config.SACNAddress).Should(Equal(c.SACNAddress))
+			Ω(state.config.Reservoir).Should(Equal(c.Reservoir))
+		})
+	})
+
+	Context("saving", func() {
+		var dir string
+
+		BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "weathermachine")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should only update the fields that changed, leaving the rest of the file alone", func() {
+			file := filepath.Join(dir, "weather-machine.json")
+			ioutil.WriteFile(file, []byte("{\n\t\"Notes\":\"Gallery 2\",\n\t\"SmokeVolume\":40,\n\t\"HRMMacAddress\":\"0\"\n}\n"), 0644)
+
+			c := defaultConfiguration()
+			c.SmokeVolume = 40
+			c.HRMMacAddress = "FF:FF:FF:FF:FF:FF"
+			c.FanDuration = 900
+			Ω(saveConfiguration(file, c)).Should(BeNil())
+
+			b, _ := ioutil.ReadFile(file)
+			Ω(string(b)).Should(Equal("{\n\t\"Notes\":\"Gallery 2\",\n\t\"SmokeVolume\":40,\n\t\"HRMMacAddress\":\"FF:FF:FF:FF:FF:FF\",\n\t\"FanDuration\":900\n}\n"))
+
+			backups, _ := filepath.Glob(file + ".*.bak")
+			Ω(backups).Should(HaveLen(1))
+		})
+
+		It("should rewrite TOML files, keeping the original as a backup", func() {
+			file := filepath.Join(dir, "weather-machine.toml")
+			ioutil.WriteFile(file, []byte("# Gallery 2\nSmokeVolume = 40\nNotes = \"Gallery 2\"\n"), 0644)
+
+			c := defaultConfiguration()
+			c.SmokeVolume = 40
+			c.FanDuration = 900
+			c.HRMMacAddress = "FF:FF:FF:FF:FF:FF"
+			Ω(saveConfiguration(file, c)).Should(BeNil())
+
+			b, _ := ioutil.ReadFile(file)
+			Ω(string(b)).Should(Equal("FanDuration = 900\nHRMMacAddress = \"FF:FF:FF:FF:FF:FF\"\nNotes = \"Gallery 2\"\nSmokeVolume = 40\n"))
+
+			backups, _ := filepath.Glob(file + ".*.bak")
+			Ω(backups).Should(HaveLen(1))
+			b, _ = ioutil.ReadFile(backups[0])
+			Ω(string(b)).Should(ContainSubstring("# Gallery 2"))
+		})
+
+		It("should keep a separate backup for each save, however quick, up to the limit", func() {
+			file := filepath.Join(dir, "weather-machine.json")
+			ioutil.WriteFile(file, []byte("{\n\t\"SmokeVolume\":0\n}\n"), 0644)
+
+			c := defaultConfiguration()
+			for v := 1; v <= maxBackups+2; v++ {
+				c.SmokeVolume = v
+				Ω(saveConfiguration(file, c)).Should(BeNil())
+			}
+
+			backups, _ := filepath.Glob(file + ".*.bak")
+			Ω(backups).Should(HaveLen(maxBackups))
+
+			// The oldest backups were pruned, the newest holds the save before last.
+			sort.Strings(backups)
+			b, _ := ioutil.ReadFile(backups[0])
+			Ω(string(b)).Should(ContainSubstring("\"SmokeVolume\":2"))
+			b, _ = ioutil.ReadFile(backups[maxBackups-1])
+			Ω(string(b)).Should(ContainSubstring(fmt.Sprintf("\"SmokeVolume\":%d", maxBackups+1)))
+		})
+
+		It("should create a missing file with just the fields that differ from the defaults", func() {
+			file := filepath.Join(dir, "weather-machine.json")
+
+			c := defaultConfiguration()
+			c.HRMMacAddress = "FF:FF:FF:FF:FF:FF"
+			Ω(saveConfiguration(file, c)).Should(BeNil())
+
+			l, err := loadConfiguration(file)
+			Ω(err).Should(BeNil())
+			Ω(l).Should(Equal(c))
+
+			backups, _ := filepath.Glob(file + ".*.bak")
+			Ω(backups).Should(BeEmpty())
+		})
+
+		It("should update YAML files, keeping their comments", func() {
+			file := filepath.Join(dir, "weather-machine.yaml")
+			ioutil.WriteFile(file, []byte("# Gallery 2\nSmokeVolume: 40 # Low ceiling.\nHRMMacAddress: \"0\"\n"), 0644)
+
+			c := defaultConfiguration()
+			c.SmokeVolume = 40
+			c.HRMMacAddress = "FF:FF:FF:FF:FF:FF"
+			c.S1Beat.Red = 100
+			Ω(saveConfiguration(file, c)).Should(BeNil())
+
+			b, _ := ioutil.ReadFile(file)
+			Ω(string(b)).Should(Equal("# Gallery 2\nSmokeVolume: 40 # Low ceiling.\nHRMMacAddress: FF:FF:FF:FF:FF:FF\nS1Beat:\n  Red: 100\n  Green: 10\n  Blue: 10\n  Amber: 50\n  Dimmer: 155\n"))
+
+			l, err := loadConfiguration(file)
+			Ω(err).Should(BeNil())
+			Ω(l).Should(Equal(c))
+		})
+
+		It("should leave a file it can not parse untouched", func() {
+			file := filepath.Join(dir, "weather-machine.json")
+			ioutil.WriteFile(file, []byte("{\"SmokeVolume\":"), 0644)
+
+			c := defaultConfiguration()
+			c.SmokeVolume = 80
+			Ω(saveConfiguration(file, c)).ShouldNot(BeNil())
+
+			b, _ := ioutil.ReadFile(file)
+			Ω(string(b)).Should(Equal("{\"SmokeVolume\":"))
+		})
+	})
+
+	Context("profiles", func() {
+		It("should layer the active profile between the site file and the local overrides", func() {
+			c, err := loadLayers(configLayers{"testdata/test-config-profiles.json", "", []string{"WM_PROFILE=festival"}})
+
+			Ω(err).Should(BeNil())
+			Ω(c.SmokeVolume).Should(Equal(120))
+			Ω(c.S1Beat).Should(Equal(LightColour{255, 15, 15, 15, 15}))
+
+			c, err = loadLayers(configLayers{"testdata/test-config-profiles.json", "testdata/test-config.local.json", []string{"WM_PROFILE=festival"}})
+
+			Ω(err).Should(BeNil())
+			Ω(c.SmokeVolume).Should(Equal(80))
+			Ω(c.S1Beat).Should(Equal(LightColour{255, 15, 200, 15, 15}))
+		})
+
+		It("should follow the schedule, carrying the last slot over midnight", func() {
+			c, _ := loadLayers(configLayers{"testdata/test-config-profiles.json", "", nil})
+			day := time.Date(2016, 3, 12, 0, 0, 0, 0, time.Local)
+
+			Ω(activeProfile(c, day.Add(time.Hour*9))).Should(Equal("festival"))
+			Ω(activeProfile(c, day.Add(time.Hour*10))).Should(Equal("small-room"))
+			Ω(activeProfile(c, day.Add(time.Hour*19))).Should(Equal("festival"))
+			Ω(nextSlot(c.ProfileSchedule, day.Add(time.Hour*19))).Should(Equal(day.Add(time.Hour * 34)))
+
+			c.Profile = "small-room"
+			Ω(activeProfile(c, day.Add(time.Hour*19))).Should(Equal("small-room"))
+		})
+
+		It("should reject unknown and invalid profiles", func() {
+			c, _ := loadConfiguration("testdata/test-config-profiles.json")
+			c.Profile = "outdoor"
+			c.ProfileSchedule = append(c.ProfileSchedule, ProfileSlot{"25:00", ""})
+			c.Profiles["small-room"] = []byte(`{"SmokeVolume":300,"Profile":"festival"}`)
+			c.Profiles["festival"] = []byte(`{"SmokeVolume":300}`)
+
+			Ω(validateConfiguration(c)).Should(Equal(ConfigErrors{
+				"Profiles.festival.SmokeVolume: 300 is outside 0-255",
+				"Profiles.small-room.Profile: can not be set within a profile",
+				"Profile: unknown profile 'outdoor'",
+				"ProfileSchedule[2].At: '25:00' is not a time of day, such as 18:30",
+			}))
+		})
+
+		It("should record the profile chosen by hand in the local overrides file", func() {
+			dir, _ := ioutil.TempDir("", "weathermachine")
+			defer os.RemoveAll(dir)
+			layers := configLayers{"testdata/test-config-profiles.json", filepath.Join(dir, "local.json"), nil}
+
+			Ω(useProfile(layers, "outdoor")).ShouldNot(BeNil())
+			Ω(useProfile(layers, "small-room")).Should(BeNil())
+
+			c, err := loadLayers(layers)
+			Ω(err).Should(BeNil())
+			Ω(c.Profile).Should(Equal("small-room"))
+			Ω(c.SmokeVolume).Should(Equal(20))
+
+			Ω(useProfile(layers, "")).Should(BeNil())
+			c, _ = loadLayers(layers)
+			Ω(c.Profile).Should(Equal(""))
+		})
+	})
 })
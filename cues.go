@@ -0,0 +1,257 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+type Cue struct {
+	Action     string      // What the cue does; "light", "smoke", "pump" or "fan".
+	From       string      // When the cue timing starts; "contact" (default) or "heartrate", the first heart rate reading.
+	At         int         // The number of milliseconds after From to first fire the cue.
+	AtBeats    float32     // The number of heart beats to add to At.
+	Every      int         // The number of milliseconds to wait before firing the cue again. 0 fires once.
+	EveryBeats float32     // The number of heart beats to add to Every.
+	Duration   int         // The number of milliseconds a light look, smoke puff or pump burst lasts.
+	Volume     int         // The amount of smoke for a smoke puff. 0 uses SmokeVolume.
+	Colour     LightColour // The colour of a light look, shown over the top of the heartbeat.
+	On         bool        // Should a fan cue switch the fan on or off?
+}
+
+// pendingCue is a cue waiting to fire within a session.
+type pendingCue struct {
+	cue   Cue       // The cue to fire.
+	armed bool      // Is the start of the cue timing known yet?
+	next  time.Time // When the cue fires next.
+	done  bool      // Has a one shot cue already fired?
+}
+
+// loadCues reads the session timeline from the cue file at cueFile. Like the configuration, it can be
+// JSON, YAML or TOML. The cues are either a list, or listed under Cues, as TOML needs.
+func loadCues(cueFile string) (cues []Cue, err error) {
+	b, err := ioutil.ReadFile(cueFile)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = toJSON(cueFile, b); err != nil {
+		return nil, err
+	}
+
+	var listed struct {
+		Cues []Cue // The cues, for files that can't be a list on their own.
+	}
+	var v interface{} = &cues
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		v = &listed
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields() // A misspelt field would otherwise silently fall back to its default.
+	if err = decoder.Decode(v); err != nil {
+		return nil, err
+	}
+
+	if listed.Cues != nil {
+		cues = listed.Cues
+	}
+	return cues, nil
+}
+
+// sessionCues returns the timeline for a session. This is the CueFile from the configuration, or
+// without one, a timeline that pumps from contact and starts the smoke and fan once a heart rate is
+// known.
+func sessionCues(c Configuration) []Cue {
+	if c.CueFile != "" {
+		cues, err := loadCues(c.CueFile)
+		if err == nil {
+			return cues
+		}
+		log.Printf("ERROR: Unable to load cues from '%s', using the built in timeline: %v", c.CueFile, err)
+	}
+
+	return []Cue{
+		{Action: "pump", From: "contact", At: c.DeltaTPump, Every: c.PumpInterval, Duration: c.PumpDuration},
+		{Action: "smoke", From: "heartrate", At: c.DeltaTSmoke, Every: c.SmokeInterval, Duration: c.SmokeDuration},
+		{Action: "fan", From: "heartrate", At: c.DeltaTFan, On: true},
+	}
+}
+
+// beats converts a number of heart beats at the heart rate hr into a duration.
+func beats(n float32, hr int) time.Duration {
+	if n == 0 || hr <= 0 {
+		return 0
+	}
+
+	return time.Duration(float64(n) * 60000.0 / float64(hr) * float64(time.Millisecond))
+}
+
+// arm works out when the cue first fires, relative to the time start.
+func (p *pendingCue) arm(start time.Time, hr int) {
+	p.armed = true
+	p.next = start.Add(time.Millisecond*time.Duration(p.cue.At) + beats(p.cue.AtBeats, hr))
+}
+
+// interval returns how long to wait before firing the cue again, at the heart rate hr and the storm
+// heart rate bpm. Smoke follows the SmokeInterval storm curve when there is one, and smoke and rain
+// are paced by the phase ph.
+func (p *pendingCue) interval(c Configuration, hr int, bpm float32, ph Phase) time.Duration {
+	every := time.Millisecond*time.Duration(p.cue.Every) + beats(p.cue.EveryBeats, hr)
+	if p.cue.Action == "smoke" && every > 0 && len(c.Storm.SmokeInterval) > 0 && bpm > 0 {
+		every = time.Millisecond * time.Duration(curveAt(c.Storm.SmokeInterval, bpm))
+	}
+	if (p.cue.Action == "smoke" || p.cue.Action == "pump") && ph.PaceScale > 0 {
+		every = time.Duration(float64(every) * float64(ph.PaceScale))
+	}
+
+	return every
+}
+
+// fire performs the action of the cue without blocking the cue engine. The storm heart rate bpm
+// sets the smoke volume and pump duty cycle when the configuration has curves for them, which are then
+// scaled by the phase ph. every is the time till the cue fires again.
+func (p *pendingCue) fire(c Configuration, bpm float32, ph Phase, every time.Duration, dmx *FrameBuffer, smoke *SmokeGovernor, water *WaterTracker, relayCtrl *RelayControl) {
+	switch p.cue.Action {
+	case "light":
+		go lightLook(p.cue.Colour, p.cue.Duration, dmx)
+	case "smoke":
+		v := p.cue.Volume
+		if v == 0 {
+			v = c.SmokeVolume
+		}
+		if len(c.Storm.SmokeVolume) > 0 && bpm > 0 {
+			v = clampChannel(float64(curveAt(c.Storm.SmokeVolume, bpm)))
+		}
+		if v = clampChannel(float64(v) * float64(ph.SmokeScale)); v > 0 {
+			go puffSmoke(v, p.cue.Duration, smoke, dmx)
+		}
+	case "pump":
+		d := p.cue.Duration
+		if len(c.Storm.PumpDuty) > 0 && bpm > 0 && every > 0 {
+			d = int(float64(curveAt(c.Storm.PumpDuty, bpm)) * float64(every/time.Millisecond))
+		}
+		if d = int(float64(d) * float64(ph.RainScale)); d > 0 {
+			go pulsePump(c.I2CPinPump, d, water, relayCtrl)
+		}
+	case "fan":
+		if p.cue.On {
+			relayCtrl.enable(c.I2CPinFan)
+		} else {
+			relayCtrl.disable(c.I2CPinFan)
+		}
+		events.publish("fan", map[string]interface{}{"On": p.cue.On})
+	default:
+		log.Printf("ERROR: Unknown cue action '%s'", p.cue.Action)
+	}
+}
+
+// runCues plays the timeline of cues for a session that started with skin contact at the time contact.
+// Heart rate readings arrive on hr, the first of which starts the timing for cues measured from the
+// heart rate. Each cue fires with the latest live configuration. Cues continue till being notified to
+// stop on d, after which the fan runs for the FanDuration of the session to clear the smoke chamber.
+func runCues(cues []Cue, live *LiveConfig, contact time.Time, hr chan int, d chan bool, dmx *FrameBuffer, smoke *SmokeGovernor, water *WaterTracker, relayCtrl *RelayControl) {
+	c := live.get()
+	session := c // Pins and durations stay as they were when the session started.
+	heartRate := 0
+	phase := phaseAt(c.Phases, 0)
+	trend := &heartTrend{window: time.Millisecond * time.Duration(c.Storm.TrendWindow)}
+
+	pending := make([]pendingCue, len(cues))
+	for i, cue := range cues {
+		pending[i].cue = cue
+		if cue.From != "heartrate" && cue.AtBeats == 0 {
+			pending[i].arm(contact, heartRate)
+		}
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		// Wait for the next cue that is due.
+		now := time.Now()
+		wait := time.Hour
+		for _, p := range pending {
+			if p.armed && !p.done && p.next.Sub(now) < wait {
+				wait = p.next.Sub(now)
+			}
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+			now = time.Now()
+			c = live.get()
+			if ph := phaseAt(c.Phases, now.Sub(contact)); ph.Name != phase.Name {
+				log.Printf("INFO: Session entering the %s phase", ph.Name)
+				phase = ph
+			}
+
+			for i := range pending {
+				p := &pending[i]
+				if !p.armed || p.done || p.next.After(now) {
+					continue
+				}
+
+				bpm := stormBPM(c.Storm, trend)
+				every := p.interval(c, heartRate, bpm, phase)
+				p.fire(c, bpm, phase, every, dmx, smoke, water, relayCtrl)
+				if every > 0 {
+					p.next = p.next.Add(every)
+				} else {
+					p.done = true
+				}
+			}
+
+		case h := <-hr:
+			for i := range pending {
+				p := &pending[i]
+				if p.armed {
+					continue
+				}
+
+				if p.cue.From == "heartrate" {
+					p.arm(time.Now(), h)
+				} else {
+					p.arm(contact, h)
+				}
+			}
+			heartRate = h
+			trend.add(h, time.Now())
+
+		case <-d:
+			// Wait for the fan duration to clear the smoke chamber.
+			time.Sleep(time.Millisecond * time.Duration(session.FanDuration))
+			relayCtrl.disable(session.I2CPinFan)
+			events.publish("fan", map[string]interface{}{"On": false})
+			return
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Cues", func() {
+	It("should load a cue file", func() {
+		cues, err := loadCues("testdata/test-cues.json")
+
+		Ω(err).Should(BeNil())
+		Ω(cues).Should(HaveLen(4))
+		Ω(cues[0].Colour.Blue).Should(Equal(200))
+		Ω(cues[2].From).Should(Equal("heartrate"))
+		Ω(cues[2].EveryBeats).Should(BeNumerically("~", 4.0, 0.001))
+		Ω(cues[3].On).Should(BeTrue())
+	})
+
+	It("should load YAML and TOML cue files the same as JSON", func() {
+		j, _ := loadCues("testdata/test-cues.json")
+
+		for _, file := range []string{"testdata/test-cues.yaml", "testdata/test-cues.toml"} {
+			cues, err := loadCues(file)
+			Ω(err).Should(BeNil())
+			Ω(cues).Should(Equal(j))
+		}
+	})
+
+	It("should refuse cue files with unknown fields", func() {
+		_, err := loadCues("testdata/unknown-cues.json")
+
+		Ω(err).ShouldNot(BeNil())
+		Ω(err.Error()).Should(ContainSubstring("Durtion"))
+	})
+
+	It("should fall back to the built in timeline", func() {
+		c := Configuration{CueFile: "foo", DeltaTPump: 30, PumpInterval: 1000, DeltaTSmoke: 20, DeltaTFan: 40}
+		cues := sessionCues(c)
+
+		Ω(cues).Should(HaveLen(3))
+		Ω(cues[0].Action).Should(Equal("pump"))
+		Ω(cues[0].From).Should(Equal("contact"))
+		Ω(cues[0].Every).Should(Equal(1000))
+		Ω(cues[2].At).Should(Equal(40))
+	})
+
+	It("should time cues in heart beats", func() {
+		Ω(beats(2, 60)).Should(Equal(2 * time.Second))
+		Ω(beats(1, 120)).Should(Equal(500 * time.Millisecond))
+		Ω(beats(4, 0)).Should(Equal(time.Duration(0)))
+	})
+
+	It("should keep the pump running till the last of overlapping bursts ends", func() {
+		relayCtrl := NewRelayCtrl(nullBus{})
+		water := NewWaterTracker(Reservoir{FlowRate: 10}, nil)
+		pin := uint8(3)
+
+		go pulsePump(pin, 100, water, relayCtrl)
+		Eventually(func() bool { return relayCtrl.on(pin) }).Should(BeTrue())
+		time.Sleep(30 * time.Millisecond)
+
+		go pulsePump(pin, 100, water, relayCtrl)
+		Consistently(func() bool { return relayCtrl.on(pin) }, "70ms", "5ms").Should(BeTrue())
+		Eventually(func() bool { return relayCtrl.on(pin) }).Should(BeFalse())
+
+		// The bursts overlap, so the pump ran for longer than one burst, but less than two back to back.
+		Ω(water.Status().Used).Should(BeNumerically(">", 1.0))
+		Ω(water.Status().Used).Should(BeNumerically("<", 1.9))
+	})
+
+	It("should show light looks beneath lightning", func() {
+		fb := NewFrameBuffer(nullOutput{}, 40)
+		look := LightColour{10, 20, 30, 40, 50}
+
+		go lightLook(look, 20, fb)
+		Eventually(func() bool {
+			fb.mu.Lock()
+			defer fb.mu.Unlock()
+			return fb.overlaid[lookLayer][3]
+		}).Should(BeTrue())
+		overlayLight(lightningLayer, LightColour{Dimmer: 255}, fb)
+
+		Eventually(func() bool {
+			fb.mu.Lock()
+			defer fb.mu.Unlock()
+			return fb.overlaid[lookLayer][3]
+		}).Should(BeFalse())
+
+		fb.mu.Lock()
+		defer fb.mu.Unlock()
+		Ω(fb.overlaid[lightningLayer][7]).Should(BeTrue())
+		Ω(fb.overlay[lightningLayer][7]).Should(Equal(byte(255)))
+	})
+})
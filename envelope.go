@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"math"
+	"time"
+)
+
+type Envelope struct {
+	Attack int    // The number of milliseconds for the light to rise to full intensity.
+	Decay  int    // The number of milliseconds for the light to fall from full intensity to off.
+	Curve  string // The shape of the attack and decay; "linear", "exponential" or "gamma".
+}
+
+// ease maps the fraction x (0-1) of the way through an attack onto a light level (0-1) using the curve
+// of the envelope.
+func (e Envelope) ease(x float64) float64 {
+	x = math.Max(0.0, math.Min(1.0, x))
+
+	switch e.Curve {
+	case "exponential":
+		return (math.Pow(2.0, 10.0*x) - 1.0) / 1023.0
+	case "gamma":
+		return math.Pow(x, 2.2) // Perceived brightness is roughly linear with a gamma of 2.2.
+	default:
+		return x
+	}
+}
+
+// level returns the light level (0-1) at time t since the start of a beat that holds at full intensity
+// for hold. Decay mirrors the attack, so the light falls away along the same curve it rose on.
+func (e Envelope) level(t time.Duration, hold time.Duration) float64 {
+	attack := time.Millisecond * time.Duration(e.Attack)
+	decay := time.Millisecond * time.Duration(e.Decay)
+
+	switch {
+	case t < 0:
+		return 0.0
+	case t < attack:
+		return e.ease(float64(t) / float64(attack))
+	case t < attack+hold:
+		return 1.0
+	case t < attack+hold+decay:
+		return e.ease(1.0 - float64(t-attack-hold)/float64(decay))
+	}
+
+	return 0.0
+}
+
+// envelopeLight shapes a single beat of the light with the colour 'l', rising and falling according
+// to the envelope 'e' and holding at full intensity for hold milliseconds. The envelope drives the
+// dimmer channel, leaving the colour mix untouched, and is stepped at the frame rate of 'dmx'.
+func envelopeLight(l LightColour, e Envelope, hold int, c Configuration, dmx *FrameBuffer) {
+	h := time.Millisecond * time.Duration(hold)
+	total := time.Millisecond*time.Duration(e.Attack+e.Decay) + h
+
+	ticker := time.NewTicker(dmx.FramePeriod())
+	defer ticker.Stop()
+
+	start := time.Now()
+	for t := time.Duration(0); t < total; t = time.Since(start) {
+		b := l
+		b.Dimmer = clampChannel(float64(l.Dimmer) * e.level(t, h))
+		enableLight(b, c, dmx)
+
+		<-ticker.C
+	}
+
+	disableLight(c, dmx)
+}
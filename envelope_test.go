@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Envelope", func() {
+	ms := time.Millisecond
+
+	DescribeTable("levels through a beat",
+		func(e Envelope, t time.Duration, hold time.Duration, expected float64) {
+			Ω(e.level(t, hold)).Should(BeNumerically("~", expected, 0.001))
+		},
+		Entry("before the beat starts", Envelope{100, 200, "linear"}, -ms, 50*ms, 0.0),
+		Entry("at the start of the attack", Envelope{100, 200, "linear"}, 0*ms, 50*ms, 0.0),
+		Entry("part way through a linear attack", Envelope{100, 200, "linear"}, 25*ms, 50*ms, 0.25),
+		Entry("at the end of the attack", Envelope{100, 200, "linear"}, 100*ms, 50*ms, 1.0),
+		Entry("while holding", Envelope{100, 200, "linear"}, 120*ms, 50*ms, 1.0),
+		Entry("at the start of the decay", Envelope{100, 200, "linear"}, 150*ms, 50*ms, 1.0),
+		Entry("part way through a linear decay", Envelope{100, 200, "linear"}, 200*ms, 50*ms, 0.75),
+		Entry("at the end of the beat", Envelope{100, 200, "linear"}, 350*ms, 50*ms, 0.0),
+		Entry("after the beat", Envelope{100, 200, "linear"}, time.Second, 50*ms, 0.0),
+		Entry("part way through a gamma attack", Envelope{100, 100, "gamma"}, 50*ms, 0*ms, 0.2176),
+		Entry("part way through a gamma decay", Envelope{100, 100, "gamma"}, 150*ms, 0*ms, 0.2176),
+		Entry("part way through an exponential attack", Envelope{100, 100, "exponential"}, 50*ms, 0*ms, 0.0303),
+		Entry("at the end of an exponential attack", Envelope{100, 100, "exponential"}, 100*ms, 0*ms, 1.0),
+		Entry("with no attack", Envelope{0, 100, "linear"}, 0*ms, 0*ms, 1.0),
+		Entry("with no attack, hold or decay", Envelope{0, 0, "linear"}, 0*ms, 0*ms, 0.0),
+	)
+
+	DescribeTable("easing",
+		func(curve string, x float64, expected float64) {
+			Ω(Envelope{Curve: curve}.ease(x)).Should(BeNumerically("~", expected, 0.001))
+		},
+		Entry("linear at the start", "linear", 0.0, 0.0),
+		Entry("linear at the end", "linear", 1.0, 1.0),
+		Entry("exponential at the start", "exponential", 0.0, 0.0),
+		Entry("exponential at the end", "exponential", 1.0, 1.0),
+		Entry("gamma at the end", "gamma", 1.0, 1.0),
+		Entry("clamped below zero", "gamma", -0.5, 0.0),
+		Entry("clamped above one", "linear", 1.5, 1.0),
+		Entry("an unknown curve as linear", "", 0.4, 0.4),
+	)
+})
@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+// haltOutputs holds the lights and smoke at zero and opens every relay, straight away. The state
+// machine catches up with the emergency stop afterwards, whatever it happens to be doing.
+func haltOutputs(dmx *FrameBuffer, relayCtrl *RelayControl) {
+	dmx.halt(true)
+	if err := relayCtrl.halt(true); err != nil {
+		log.Printf("ERROR: Unable to switch off the fan and pump: %v", err)
+	}
+}
+
+// watchEStop polls the emergency stop button, halting the outputs and then notifying estop each time
+// it is pressed.
+func watchEStop(button *Input, estop chan bool, dmx *FrameBuffer, relayCtrl *RelayControl) {
+	if !button.Enabled() {
+		return
+	}
+
+	pressed := false
+	for range time.Tick(time.Millisecond * 20) {
+		active, err := button.Active()
+		if err != nil {
+			continue
+		}
+
+		if active && !pressed {
+			haltOutputs(dmx, relayCtrl)
+			estop <- true
+		}
+		pressed = active
+	}
+}
+
+// watchSignals passes each signal received on sig on to signals. SIGUSR1, the emergency stop from
+// software, halts the outputs before it is passed on.
+func watchSignals(sig chan os.Signal, signals chan os.Signal, dmx *FrameBuffer, relayCtrl *RelayControl) {
+	for s := range sig {
+		if s == syscall.SIGUSR1 {
+			haltOutputs(dmx, relayCtrl)
+		}
+		signals <- s
+	}
+}
+
+// emergencyStop immediately kills the smoke, water and lights, then winds down whatever the installation
+// was doing. The installation stays stopped, whatever happens on the heart rate monitor, till reset.
+func emergencyStop(state *WeatherMachine, current stateFn) stateFn {
+	if state.halted {
+		return current
+	}
+
+	state.halted = true
+	haltOutputs(state.dmx, state.relayCtrl)
+	log.Printf("WARNING: Emergency stop")
+
+	cancelTestSession(state)
+	windDown(state, current)
+
+	return stopped
+}
+
+// resetEStop returns the installation to idle after an emergency stop, or closed outside opening hours
+// with the smoke chamber purged if the venue closed during the stop. The reset is refused while the
+// emergency stop button is still held down.
+func resetEStop(state *WeatherMachine, current stateFn, button *Input) stateFn {
+	if !state.halted {
+		return current
+	}
+
+	if active, _ := button.Active(); active {
+		log.Printf("WARNING: Unable to reset, the emergency stop button is still pressed")
+		return current
+	}
+
+	state.halted = false
+	state.dmx.halt(false)
+	state.relayCtrl.halt(false)
+	log.Printf("INFO: Emergency stop reset")
+
+	if state.closed {
+		if state.purge {
+			state.purge = false
+			closeUp(state)
+		}
+		if state.opening {
+			go enableAttract(state.live, state.attract, state.dmx)
+		}
+		return closed
+	}
+
+	go enableAttract(state.live, state.attract, state.dmx)
+	return idle
+}
+
+// windDown stops any running session and attract mode, leaving the outputs to be switched off.
+func windDown(state *WeatherMachine, current stateFn) {
+	if state.closed && !state.opening {
+		return // Nothing runs while the venue is closed.
+	}
+
+	// Losing contact winds down any session and leaves the installation idle, with attract mode running.
+	current(state, HRMsg{0, false})
+	stopAttract(state.attract)
+}
+
+// stopped is the state the weathermachine enters after an emergency stop. Nothing happens till it
+// is reset.
+func stopped(state *WeatherMachine, msg HRMsg) stateFn {
+	return stopped
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"os"
+	"syscall"
+	"time"
+)
+
+// relaysHalted returns true if the relays are held open by an emergency stop.
+func relaysHalted(r *RelayControl) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.halted
+}
+
+// attracting returns true if attract mode is running on d, stopping it to find out.
+func attracting(d chan bool) bool {
+	select {
+	case d <- true:
+		<-d
+		return true
+	case <-time.After(50 * time.Millisecond):
+		return false
+	}
+}
+
+var _ = Describe("Emergency stop", func() {
+	var state WeatherMachine
+	var bus *switchBus
+	var button *Input
+
+	BeforeEach(func() {
+		c := defaultConfiguration()
+		c.Reservoir.StateFile = ""
+		c.FanDuration = 10
+		state = WeatherMachine{attract: make(chan bool), lightning: make(chan bool, 1), cueHR: make(chan int, 1),
+			pulseHR: make(chan int, 1), config: c, live: NewLiveConfig(c), dmx: NewFrameBuffer(nullOutput{}, 40),
+			smoke: NewSmokeGovernor(c.SmokeBudget), relayCtrl: NewRelayCtrl(nullBus{}),
+			water: NewWaterTracker(c.Reservoir, nil), clearAt: time.Now()}
+
+		var err error
+		bus = &switchBus{}
+		button, err = NewInput(InputPin{Source: "expander", Pin: 0, Address: 0x21}, bus)
+		Ω(err).Should(BeNil())
+	})
+
+	It("should halt the outputs and stop attract mode when idle", func() {
+		go enableAttract(state.live, state.attract, state.dmx)
+
+		update := emergencyStop(&state, idle)
+
+		Ω(stateName(update)).Should(Equal("stopped"))
+		Ω(state.halted).Should(BeTrue())
+		Ω(state.dmx.isHalted()).Should(BeTrue())
+		Ω(relaysHalted(state.relayCtrl)).Should(BeTrue())
+		Ω(state.relayCtrl.enable(state.config.I2CPinPump)).ShouldNot(BeNil())
+		Ω(attracting(state.attract)).Should(BeFalse())
+	})
+
+	It("should end a running session without waiting for it", func() {
+		go enableAttract(state.live, state.attract, state.dmx)
+		update := idle(&state, HRMsg{0, true})
+		update = update(&state, HRMsg{70, true})
+		Ω(stateName(update)).Should(Equal("running"))
+		stop := state.stop
+
+		start := time.Now()
+		update = emergencyStop(&state, update)
+
+		Ω(time.Since(start)).Should(BeNumerically("<", 100*time.Millisecond))
+		Ω(stateName(update)).Should(Equal("stopped"))
+		Ω(stop).Should(BeClosed())
+		Ω(state.inSession).Should(BeFalse())
+	})
+
+	It("should cancel a test session", func() {
+		go enableAttract(state.live, state.attract, state.dmx)
+		hr := make(chan HRMsg)
+		startTestSession(&state, idle, 70, hr)
+
+		emergencyStop(&state, idle)
+
+		Ω(state.testing).Should(BeNil())
+		Ω(state.lastMsg.Contact).Should(BeFalse())
+		Consistently(hr, "100ms").ShouldNot(Receive())
+	})
+
+	It("should only stop once", func() {
+		state.halted = true
+
+		Ω(stateName(emergencyStop(&state, stopped))).Should(Equal("stopped"))
+		Ω(stateName(emergencyStop(&state, closed))).Should(Equal("closed"))
+	})
+
+	It("should ignore the heart rate monitor till reset", func() {
+		Ω(stateName(stopped(&state, HRMsg{70, true}))).Should(Equal("stopped"))
+		Ω(stateName(stopped(&state, HRMsg{0, false}))).Should(Equal("stopped"))
+	})
+
+	It("should refuse to reset while the button is still pressed", func() {
+		emergencyStop(&state, finished)
+		bus.set(1)
+
+		Ω(stateName(resetEStop(&state, stopped, button))).Should(Equal("stopped"))
+		Ω(state.halted).Should(BeTrue())
+		Ω(relaysHalted(state.relayCtrl)).Should(BeTrue())
+	})
+
+	It("should release the outputs and return to idle once reset", func() {
+		emergencyStop(&state, finished)
+
+		update := resetEStop(&state, stopped, button)
+
+		Ω(stateName(update)).Should(Equal("idle"))
+		Ω(state.halted).Should(BeFalse())
+		Ω(state.dmx.isHalted()).Should(BeFalse())
+		Ω(relaysHalted(state.relayCtrl)).Should(BeFalse())
+		Ω(attracting(state.attract)).Should(BeTrue())
+	})
+
+	It("should stay closed when reset outside of opening hours", func() {
+		state.closed = true
+		emergencyStop(&state, closed)
+
+		Ω(stateName(resetEStop(&state, stopped, button))).Should(Equal("closed"))
+		Ω(state.halted).Should(BeFalse())
+		Ω(attracting(state.attract)).Should(BeFalse())
+	})
+
+	It("should halt the outputs as soon as the button is pressed", func() {
+		estop := make(chan bool)
+		go watchEStop(button, estop, state.dmx, state.relayCtrl)
+
+		bus.set(1)
+
+		// Nothing has received from estop yet, the main loop could be busy.
+		Eventually(func() bool { return relaysHalted(state.relayCtrl) }).Should(BeTrue())
+		Ω(state.dmx.isHalted()).Should(BeTrue())
+		Eventually(estop).Should(Receive())
+	})
+
+	It("should halt the outputs as soon as SIGUSR1 arrives", func() {
+		sig := make(chan os.Signal, 1)
+		signals := make(chan os.Signal)
+		go watchSignals(sig, signals, state.dmx, state.relayCtrl)
+		defer close(sig)
+
+		sig <- syscall.SIGUSR2
+		Eventually(signals).Should(Receive(Equal(syscall.SIGUSR2)))
+		Ω(relaysHalted(state.relayCtrl)).Should(BeFalse())
+
+		sig <- syscall.SIGUSR1
+		Eventually(func() bool { return relaysHalted(state.relayCtrl) }).Should(BeTrue())
+		Ω(state.dmx.isHalted()).Should(BeTrue())
+		Eventually(signals).Should(Receive(Equal(syscall.SIGUSR1)))
+	})
+})
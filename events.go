@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventBuffer is the number of events each subscriber can fall behind by before events are dropped.
+const eventBuffer = 64
+
+// Event is something the installation did, streamed to anyone watching.
+type Event struct {
+	Type string      // What happened; "state", "heartrate", "beat", "lightning", "smoke", "fan" or "pump".
+	Time time.Time   // When it happened.
+	Data interface{} // The details, which depend on the type of event.
+}
+
+// EventHub passes events on to every subscriber, without ever holding up the installation.
+type EventHub struct {
+	mu          sync.Mutex          // Guards subscribers.
+	subscribers map[chan Event]bool // The channels of everyone watching.
+}
+
+// events is where the installation publishes everything it does.
+var events = NewEventHub()
+
+// NewEventHub creates an event hub without any subscribers.
+func NewEventHub() *EventHub {
+	return &EventHub{subscribers: map[chan Event]bool{}}
+}
+
+// subscribe returns a channel that receives every event published from now on.
+func (h *EventHub) subscribe() chan Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := make(chan Event, eventBuffer)
+	h.subscribers[c] = true
+	return c
+}
+
+// unsubscribe stops sending events to c.
+func (h *EventHub) unsubscribe(c chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subscribers, c)
+}
+
+// publish sends an event to every subscriber. Subscribers that have fallen too far behind miss out.
+func (h *EventHub) publish(t string, data interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e := Event{t, time.Now(), data}
+	for c := range h.subscribers {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// allowedOrigin returns true if the WebSocket request r comes from a page served by the API itself,
+// from one of the other origins allowed, or from outside of a browser, which sends no Origin. Anything
+// else is refused, so that a web page can't watch the installation from someone's browser.
+func allowedOrigin(r *http.Request, origins []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, o := range origins {
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// streamEvents upgrades the request to a WebSocket and streams every event published on h to it as
+// JSON, till the client goes away. Only the origins allowed by allowedOrigin can connect.
+func streamEvents(h *EventHub, origins []string, w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return allowedOrigin(r, origins) }}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // The upgrader has already replied with the error.
+	}
+	defer conn.Close()
+
+	sub := h.subscribe()
+	defer h.unsubscribe(sub)
+
+	// Nothing is expected from the client, but reading is how we find out it has gone.
+	gone := make(chan bool)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				close(gone)
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(time.Second * 30)
+	defer ping.Stop()
+
+	for {
+		select {
+		case e := <-sub:
+			conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+			if err := conn.WriteJSON(e); err != nil {
+				log.Printf("WARNING: Dropping event stream to %s: %v", r.RemoteAddr, err)
+				return
+			}
+
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second*10)); err != nil {
+				return
+			}
+
+		case <-gone:
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Events", func() {
+	It("should drop events for subscribers that fall behind, rather than wait for them", func() {
+		h := NewEventHub()
+		sub := h.subscribe()
+
+		for i := 0; i < eventBuffer+10; i++ {
+			h.publish("heartrate", HRMsg{i, true})
+		}
+		Ω(sub).Should(HaveLen(eventBuffer))
+
+		h.unsubscribe(sub)
+		h.publish("heartrate", HRMsg{60, true})
+		Ω(sub).Should(HaveLen(eventBuffer))
+	})
+
+	It("should stream events over a WebSocket", func() {
+		h := NewEventHub()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			streamEvents(h, nil, w, r)
+		}))
+		defer server.Close()
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		Ω(err).Should(BeNil())
+		defer conn.Close()
+
+		Eventually(func() int {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			return len(h.subscribers)
+		}).Should(Equal(1))
+		h.publish("heartrate", HRMsg{72, true})
+
+		var e struct {
+			Type string
+			Data HRMsg
+		}
+		Ω(conn.ReadJSON(&e)).Should(BeNil())
+		Ω(e.Type).Should(Equal("heartrate"))
+		Ω(e.Data).Should(Equal(HRMsg{72, true}))
+	})
+
+	It("should only stream to pages from the API itself, or from the origins allowed", func() {
+		h := NewEventHub()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			streamEvents(h, []string{"http://dashboard.local/"}, w, r)
+		}))
+		defer server.Close()
+
+		dial := func(origin string) error {
+			header := http.Header{}
+			if origin != "" {
+				header.Set("Origin", origin)
+			}
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}
+
+		Ω(dial("")).Should(BeNil())
+		Ω(dial(server.URL)).Should(BeNil())
+		Ω(dial("http://dashboard.local")).Should(BeNil())
+		Ω(dial("http://elsewhere.example")).ShouldNot(BeNil())
+		Ω(dial("null")).ShouldNot(BeNil())
+	})
+
+	It("should keep streaming past the timeouts of the server", func() {
+		h := NewEventHub()
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			streamEvents(h, nil, w, r)
+		})
+		server := httptest.NewUnstartedServer(handler)
+		server.Config = newHTTPServer("", handler)
+		Ω(server.Config.ReadTimeout).Should(BeNumerically(">", 0))
+		Ω(server.Config.WriteTimeout).Should(BeNumerically(">", 0))
+		Ω(server.Config.IdleTimeout).Should(BeNumerically(">", 0))
+
+		server.Config.ReadTimeout = time.Millisecond * 50
+		server.Config.WriteTimeout = time.Millisecond * 50
+		server.Start()
+		defer server.Close()
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		Ω(err).Should(BeNil())
+		defer conn.Close()
+
+		time.Sleep(time.Millisecond * 200)
+		h.publish("heartrate", HRMsg{72, true})
+
+		var e struct {
+			Type string
+			Data HRMsg
+		}
+		Ω(conn.ReadJSON(&e)).Should(BeNil())
+		Ω(e.Data).Should(Equal(HRMsg{72, true}))
+	})
+})
@@ -0,0 +1,312 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// configFormat returns the format of the configuration file, chosen by its extension; "yaml" for .yaml
+// and .yml files, "toml" for .toml files and "json" for everything else.
+func configFormat(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+
+	return "json"
+}
+
+// readLayer reads the configuration file, converting it to JSON and migrating it to the current version
+// for decoding.
+func readLayer(file string) ([]byte, error) {
+	b, applied, err := readMigrated(file)
+	noteMigration(file, applied)
+
+	return b, err
+}
+
+// readMigrated reads the configuration file, converting it to JSON and migrating it to the current
+// version. It returns the description of each migration applied.
+func readMigrated(file string) ([]byte, []string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if b, err = toJSON(file, b); err != nil {
+		return nil, nil, err
+	}
+
+	b, applied := migrate(b)
+	return b, applied, nil
+}
+
+// toJSON converts the configuration b, in the format of file, into JSON.
+func toJSON(file string, b []byte) ([]byte, error) {
+	var v interface{}
+
+	switch configFormat(file) {
+	case "yaml":
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+	case "toml":
+		var m map[string]interface{}
+		if _, err := toml.Decode(string(b), &m); err != nil {
+			return nil, err
+		}
+		if m != nil {
+			v = m
+		}
+	default:
+		return b, nil
+	}
+
+	if v == nil {
+		return nil, nil // An empty file sets nothing.
+	}
+	return json.Marshal(v)
+}
+
+// fromJSON converts the JSON configuration b into the format of file. YAML keeps the order of the
+// fields in b, while TOML sorts them and drops any fields that are null.
+func fromJSON(file string, b []byte) ([]byte, error) {
+	switch configFormat(file) {
+	case "yaml":
+		// JSON is already YAML, it just needs restyling.
+		var doc yaml.Node
+		if err := yaml.Unmarshal(b, &doc); err != nil {
+			return nil, err
+		}
+		blockStyle(&doc)
+		return encodeYAML(&doc, 2)
+
+	case "toml":
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.UseNumber()
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			return nil, err
+		}
+
+		buf := bytes.Buffer{}
+		if err := toml.NewEncoder(&buf).Encode(plainValue(v)); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	buf := bytes.Buffer{}
+	if err := json.Indent(&buf, b, "", "\t"); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
+
+// plainValue converts the numbers in the decoded JSON v into integers where they are whole, and removes
+// any nulls, ready for encoding as TOML.
+func plainValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+
+	case map[string]interface{}:
+		for k, e := range t {
+			if e == nil {
+				delete(t, k)
+				continue
+			}
+			t[k] = plainValue(e)
+		}
+
+	case []interface{}:
+		for i, e := range t {
+			t[i] = plainValue(e)
+		}
+	}
+
+	return v
+}
+
+// blockStyle clears the JSON flow style and quoting from every node under n.
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
+
+// encodeYAML writes the YAML document doc, indented by indent spaces.
+func encodeYAML(doc *yaml.Node, indent int) ([]byte, error) {
+	buf := bytes.Buffer{}
+	e := yaml.NewEncoder(&buf)
+	e.SetIndent(indent)
+	if err := e.Encode(doc); err != nil {
+		return nil, err
+	}
+	e.Close()
+
+	return buf.Bytes(), nil
+}
+
+// yamlIndent returns the number of spaces the YAML b is indented by, 2 if it has no indented lines.
+func yamlIndent(b []byte) int {
+	for _, line := range strings.Split(string(b), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed != "" && len(trimmed) < len(line) && !strings.HasPrefix(trimmed, "#") {
+			return len(line) - len(trimmed)
+		}
+	}
+
+	return 2
+}
+
+// updateYAML returns the YAML configuration b with the values of the changed fields taken from c. Fields
+// already in b are updated where they are, keeping their comments, and new fields are added to the end.
+func updateYAML(b []byte, c Configuration, changed []string) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+
+	m := doc.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("expected a YAML mapping")
+	}
+
+	v := reflect.ValueOf(c)
+	for _, name := range changed {
+		j, err := json.Marshal(v.FieldByName(name).Interface())
+		if err != nil {
+			return nil, err
+		}
+		var val yaml.Node
+		if err = yaml.Unmarshal(j, &val); err != nil {
+			return nil, err
+		}
+		blockStyle(&val)
+		value := val.Content[0]
+
+		found := false
+		for i := 0; i+1 < len(m.Content); i += 2 {
+			if strings.EqualFold(m.Content[i].Value, name) {
+				value.LineComment = m.Content[i+1].LineComment
+				m.Content[i+1] = value
+				found = true
+			}
+		}
+
+		if !found {
+			m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name}, value)
+		}
+	}
+
+	return encodeYAML(&doc, yamlIndent(b))
+}
+
+// convertConfiguration converts the configuration file from into the format of the file to, each chosen
+// by their extension. Comments are not carried across. Fields keep their order when converting from
+// JSON, but are sorted by name when converting from YAML or TOML, or when the file had to be migrated.
+// An existing file at to is never overwritten.
+func convertConfiguration(from string, to string) error {
+	b, applied, err := readMigrated(from)
+	if err != nil {
+		return err
+	}
+
+	c := defaultConfiguration()
+	if err = decodeLayer(b, &c); err != nil {
+		return err
+	}
+
+	out, err := fromJSON(to, b)
+	if err != nil {
+		return err
+	}
+
+	if _, err = os.Stat(to); err == nil {
+		return fmt.Errorf("'%s' already exists", to)
+	}
+	if err = writeAtomic(to, out, 0644); err != nil {
+		return err
+	}
+
+	for _, a := range applied {
+		log.Printf("INFO: Migrated '%s' %s, writing '%s'", from, a, to)
+	}
+	return nil
+}
+
+// updateTOML returns the TOML configuration b with the values of the changed fields taken from c, and
+// new fields added. TOML can't be edited in place, so the whole file is written out again, sorted and
+// without its comments.
+func updateTOML(b []byte, c Configuration, changed []string) ([]byte, error) {
+	j, err := toJSON("update.toml", b)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	if j != nil {
+		if err = json.Unmarshal(j, &fields); err != nil {
+			return nil, err
+		}
+	}
+
+	v := reflect.ValueOf(c)
+	for _, name := range changed {
+		val, err := json.Marshal(v.FieldByName(name).Interface())
+		if err != nil {
+			return nil, err
+		}
+
+		key, found := findField(fields, name)
+		if !found {
+			key = name
+		}
+		fields[key] = val
+	}
+
+	if j, err = json.Marshal(fields); err != nil {
+		return nil, err
+	}
+	return fromJSON("update.toml", j)
+}
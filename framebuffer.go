@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// keepAlive is the longest the frame buffer will go without rendering, even if nothing has changed.
+// sACN receivers drop a source after 2.5 seconds of silence.
+const keepAlive = time.Second
+
+// Overlay layers, from the bottom up. Each layer hides the layers beneath it and the frame itself.
+const (
+	lookLayer      = iota // Light looks fired by cues.
+	lightningLayer        // Lightning strikes.
+	overlayLayers         // The number of overlay layers.
+)
+
+// FrameBuffer holds the 512 DMX channel values for the installation. Effects write into the frame
+// buffer and a single goroutine owns the DMX output, rendering at a fixed rate whenever the frame
+// has changed.
+type FrameBuffer struct {
+	mu       sync.Mutex               // Guards frame, overlay, overlaid, owners, dirty and halted.
+	out      DMXOutput                // The DMX output that frames are rendered to.
+	frame    [512]byte                // The channel values for the next render.
+	overlay  [overlayLayers][512]byte // Channel values layered over the frame, such as lightning.
+	overlaid [overlayLayers][512]bool // Does the overlay layer currently hide the value beneath for a channel?
+	owners   [overlayLayers]int       // The token of the effect that last claimed each overlay layer.
+	dirty    bool                     // Has the frame changed since the last render?
+	halted   bool                     // Is the output held at zero by an emergency stop?
+	rate     int                      // The number of frames per second to render.
+}
+
+// NewFrameBuffer creates a frame buffer that renders to out, rate times a second.
+func NewFrameBuffer(out DMXOutput, rate int) *FrameBuffer {
+	if rate <= 0 {
+		rate = 40
+	}
+
+	return &FrameBuffer{out: out, rate: rate}
+}
+
+// SetChannel sets the value of the DMX channel (1-512) for the next render.
+func (fb *FrameBuffer) SetChannel(channel int, val byte) {
+	if channel < 1 || channel > 512 {
+		return
+	}
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	if fb.frame[channel-1] != val {
+		fb.frame[channel-1] = val
+		fb.dirty = true
+	}
+}
+
+// SetOverlay layers val over the DMX channel (1-512) on the overlay layer, hiding whatever the channel
+// is set to underneath till the overlay is cleared.
+func (fb *FrameBuffer) SetOverlay(layer int, channel int, val byte) {
+	if channel < 1 || channel > 512 || layer < 0 || layer >= overlayLayers {
+		return
+	}
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	if !fb.overlaid[layer][channel-1] || fb.overlay[layer][channel-1] != val {
+		fb.overlay[layer][channel-1] = val
+		fb.overlaid[layer][channel-1] = true
+		fb.dirty = true
+	}
+}
+
+// ClearOverlay removes the overlay layer from the DMX channel (1-512), revealing the value underneath.
+func (fb *FrameBuffer) ClearOverlay(layer int, channel int) {
+	if channel < 1 || channel > 512 || layer < 0 || layer >= overlayLayers {
+		return
+	}
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	if fb.overlaid[layer][channel-1] {
+		fb.overlaid[layer][channel-1] = false
+		fb.dirty = true
+	}
+}
+
+// ClaimOverlay takes over the overlay layer for an effect, returning the token it releases the layer
+// with. Claiming the layer again takes it away from the effect.
+func (fb *FrameBuffer) ClaimOverlay(layer int) int {
+	if layer < 0 || layer >= overlayLayers {
+		return 0
+	}
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	fb.owners[layer]++
+	return fb.owners[layer]
+}
+
+// ReleaseOverlay removes the overlay layer from the DMX channels (1-512), as long as the layer hasn't
+// been claimed by another effect since it was claimed with token. It returns true if it was cleared.
+func (fb *FrameBuffer) ReleaseOverlay(layer int, token int, channels ...int) bool {
+	if layer < 0 || layer >= overlayLayers {
+		return false
+	}
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	if fb.owners[layer] != token {
+		return false
+	}
+
+	for _, channel := range channels {
+		if channel >= 1 && channel <= 512 && fb.overlaid[layer][channel-1] {
+			fb.overlaid[layer][channel-1] = false
+			fb.dirty = true
+		}
+	}
+	return true
+}
+
+// Channel returns the value of the DMX channel (1-512) in the frame buffer, ignoring any overlay.
+func (fb *FrameBuffer) Channel(channel int) byte {
+	if channel < 1 || channel > 512 {
+		return 0
+	}
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	return fb.frame[channel-1]
+}
+
+// halt holds every channel of the output at zero, or releases it again, for an emergency stop.
+// Effects can keep writing to the frame buffer but nothing reaches the output while it is halted.
+func (fb *FrameBuffer) halt(h bool) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	fb.halted = h
+	fb.dirty = true
+}
+
+// isHalted returns true if the output is held at zero by an emergency stop.
+func (fb *FrameBuffer) isHalted() bool {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	return fb.halted
+}
+
+// blackout writes a frame with every channel at zero straight to the output. The refresh goroutine
+// must already be stopped, as this is the last thing written before the output is closed.
+func (fb *FrameBuffer) blackout() error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	for i := range fb.frame {
+		fb.frame[i] = 0
+		for l := range fb.overlaid {
+			fb.overlaid[l][i] = false
+		}
+		fb.out.SetChannel(i+1, 0)
+	}
+
+	return fb.out.Render()
+}
+
+// FramePeriod returns the time between renders, effects that change over time step at this rate.
+func (fb *FrameBuffer) FramePeriod() time.Duration {
+	return time.Second / time.Duration(fb.rate)
+}
+
+// refresh renders the frame buffer to the DMX output. It is the only goroutine that writes to the
+// output and runs till being notified to stop on d.
+func (fb *FrameBuffer) refresh(d chan bool) {
+	ticker := time.NewTicker(fb.FramePeriod())
+	defer ticker.Stop()
+
+	lastRender := time.Time{}
+	failing := false
+
+	for {
+		select {
+		case <-ticker.C:
+			fb.mu.Lock()
+			if !fb.dirty && time.Since(lastRender) < keepAlive {
+				fb.mu.Unlock()
+				continue
+			}
+
+			for i, v := range fb.frame {
+				for l := range fb.overlay {
+					if fb.overlaid[l][i] {
+						v = fb.overlay[l][i]
+					}
+				}
+				if fb.halted {
+					v = 0
+				}
+				fb.out.SetChannel(i+1, v)
+			}
+			fb.dirty = false
+			fb.mu.Unlock()
+
+			err := fb.out.Render()
+			lastRender = time.Now()
+			if err != nil && !failing {
+				log.Printf("ERROR: Unable to render DMX frame: %v", err)
+			}
+			failing = err != nil
+
+		case <-d:
+			return
+		}
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"sync"
+)
+
+// recordingOutput is a DMX output that remembers the last frame rendered to it. Once closed, or
+// when told to fail, every write returns an error.
+type recordingOutput struct {
+	mu       sync.Mutex // Guards every field below.
+	pending  [512]byte  // The channel values written since the last render.
+	rendered [512]byte  // The channel values of the last successful render.
+	renders  int        // The number of successful renders.
+	failed   int        // The number of renders that returned an error.
+	closed   bool       // Has the output been closed?
+	fail     bool       // Should every write fail, like a disconnected interface?
+}
+
+func (o *recordingOutput) SetChannel(channel int, val byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed || o.fail {
+		return errors.New("output unavailable")
+	}
+	o.pending[channel-1] = val
+	return nil
+}
+
+func (o *recordingOutput) Render() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed || o.fail {
+		o.failed++
+		return errors.New("output unavailable")
+	}
+	o.rendered = o.pending
+	o.renders++
+	return nil
+}
+
+func (o *recordingOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.closed = true
+	return nil
+}
+
+// channel returns the value of the DMX channel (1-512) in the last successful render.
+func (o *recordingOutput) channel(c int) byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.rendered[c-1]
+}
+
+func (o *recordingOutput) counts() (int, int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.renders, o.failed
+}
+
+var _ = Describe("Frame buffer", func() {
+	var out *recordingOutput
+	var fb *FrameBuffer
+	var d chan bool
+
+	BeforeEach(func() {
+		out = &recordingOutput{}
+		fb = NewFrameBuffer(out, 200)
+		d = make(chan bool)
+		go fb.refresh(d)
+	})
+
+	AfterEach(func() {
+		d <- true
+	})
+
+	Context("overlays", func() {
+		It("should replace only the overlaid channels of the frame", func() {
+			fb.SetChannel(4, 100)
+			fb.SetChannel(5, 20)
+			fb.SetOverlay(lightningLayer, 5, 255)
+
+			Eventually(func() byte { return out.channel(5) }).Should(Equal(byte(255)))
+			Ω(out.channel(4)).Should(Equal(byte(100)))
+			Ω(fb.Channel(5)).Should(Equal(byte(20)))
+		})
+
+		It("should reveal changes made underneath once the overlay is cleared", func() {
+			fb.SetChannel(4, 100)
+			fb.SetOverlay(lightningLayer, 4, 255)
+			fb.SetChannel(4, 30)
+			Eventually(func() byte { return out.channel(4) }).Should(Equal(byte(255)))
+
+			fb.ClearOverlay(lightningLayer, 4)
+			Eventually(func() byte { return out.channel(4) }).Should(Equal(byte(30)))
+		})
+
+		It("should show the highest overlay layer", func() {
+			fb.SetChannel(4, 100)
+			fb.SetOverlay(lookLayer, 4, 50)
+			fb.SetOverlay(lightningLayer, 4, 255)
+			Eventually(func() byte { return out.channel(4) }).Should(Equal(byte(255)))
+
+			fb.ClearOverlay(lightningLayer, 4)
+			Eventually(func() byte { return out.channel(4) }).Should(Equal(byte(50)))
+
+			fb.ClearOverlay(lookLayer, 4)
+			Eventually(func() byte { return out.channel(4) }).Should(Equal(byte(100)))
+		})
+
+		It("should be able to overlay a channel with zero", func() {
+			fb.SetChannel(6, 90)
+			Eventually(func() byte { return out.channel(6) }).Should(Equal(byte(90)))
+
+			fb.SetOverlay(lookLayer, 6, 0)
+			Eventually(func() byte { return out.channel(6) }).Should(Equal(byte(0)))
+		})
+	})
+
+	Context("halting", func() {
+		It("should blank every channel, overlays included, till released", func() {
+			fb.SetChannel(1, 63)
+			fb.SetChannel(4, 200)
+			fb.SetOverlay(lookLayer, 7, 255)
+			Eventually(func() byte { return out.channel(7) }).Should(Equal(byte(255)))
+
+			fb.halt(true)
+			Eventually(func() [512]byte {
+				out.mu.Lock()
+				defer out.mu.Unlock()
+				return out.rendered
+			}).Should(Equal([512]byte{}))
+
+			fb.SetChannel(8, 155)
+			Consistently(func() byte { return out.channel(8) }, "50ms").Should(Equal(byte(0)))
+
+			fb.halt(false)
+			Eventually(func() byte { return out.channel(8) }).Should(Equal(byte(155)))
+			Ω(out.channel(1)).Should(Equal(byte(63)))
+			Ω(out.channel(4)).Should(Equal(byte(200)))
+			Ω(out.channel(7)).Should(Equal(byte(255)))
+		})
+	})
+
+	Context("after the output is closed", func() {
+		It("should keep refreshing without rendering, till stopped", func() {
+			fb.SetChannel(4, 100)
+			Eventually(func() byte { return out.channel(4) }).Should(Equal(byte(100)))
+			out.Close()
+			renders, _ := out.counts()
+
+			fb.SetChannel(4, 10)
+			Eventually(func() int { _, failed := out.counts(); return failed }).Should(BeNumerically(">", 0))
+			Ω(out.channel(4)).Should(Equal(byte(100)))
+			after, _ := out.counts()
+			Ω(after).Should(Equal(renders))
+		})
+
+		It("should report a failed blackout", func() {
+			out.Close()
+			Ω(fb.blackout()).ShouldNot(BeNil())
+			Ω(fb.Channel(4)).Should(Equal(byte(0)))
+		})
+	})
+})
@@ -0,0 +1,255 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// The parts of the day the opening hours divide time into.
+const (
+	hoursClosed  = iota // The venue is closed, the installation ignores everyone.
+	hoursOpening        // The venue is about to open, attract mode runs but sessions don't.
+	hoursOpen           // The venue is open, sessions run as normal.
+)
+
+type OpenPeriod struct {
+	Weekday string // The day of the week the period is on, such as "Monday".
+	Open    string // The time of day the installation starts accepting sessions, such as "09:30".
+	Close   string // The time of day the installation stops accepting sessions, such as "17:00".
+}
+
+type OpenDate struct {
+	Date  string // The date the exception is for, such as "2016-12-25".
+	Open  string // The time of day the installation starts accepting sessions. Empty to stay closed all day.
+	Close string // The time of day the installation stops accepting sessions. Empty to stay closed all day.
+}
+
+type OpeningHours struct {
+	Weekly        []OpenPeriod // The periods the installation is open each week. Empty to be open all day, other than on exceptions.
+	Exceptions    []OpenDate   // Dates that replace the weekly hours, such as public holidays.
+	PurgeDuration int          // The number of milliseconds to run the fan at closing time, clearing the smoke chamber.
+	AttractBefore int          // The number of milliseconds before opening to start attract mode. 0 to stay dark till opening.
+}
+
+// openPeriods returns the times the installation opens and closes on the day containing t. Without
+// any weekly hours, days without an exception are open from midnight to midnight.
+func (h OpeningHours) openPeriods(t time.Time) [][2]time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	at := func(open string, close string) ([2]time.Time, bool) {
+		o, err := minuteOfDay(open)
+		if err != nil {
+			return [2]time.Time{}, false
+		}
+		c, err := minuteOfDay(close)
+		if err != nil {
+			return [2]time.Time{}, false
+		}
+		return [2]time.Time{midnight.Add(time.Minute * time.Duration(o)), midnight.Add(time.Minute * time.Duration(c))}, true
+	}
+
+	periods := [][2]time.Time{}
+	exception := false
+	for _, d := range h.Exceptions {
+		if d.Date != t.Format("2006-01-02") {
+			continue
+		}
+		exception = true
+		if p, ok := at(d.Open, d.Close); ok {
+			periods = append(periods, p)
+		}
+	}
+	if exception {
+		return periods
+	}
+
+	if len(h.Weekly) == 0 {
+		return [][2]time.Time{{midnight, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())}}
+	}
+
+	for _, w := range h.Weekly {
+		if w.Weekday != t.Weekday().String() {
+			continue
+		}
+		if p, ok := at(w.Open, w.Close); ok {
+			periods = append(periods, p)
+		}
+	}
+
+	return periods
+}
+
+// hoursAt returns the part of the day, closed, opening or open, that the opening hours h give at the
+// time now.
+func hoursAt(h OpeningHours, now time.Time) int {
+	if len(h.Weekly) == 0 && len(h.Exceptions) == 0 {
+		return hoursOpen
+	}
+
+	before := time.Millisecond * time.Duration(h.AttractBefore)
+	result := hoursClosed
+	for _, day := range []time.Time{now, now.Add(before)} {
+		for _, p := range h.openPeriods(day) {
+			if !now.Before(p[0]) && now.Before(p[1]) {
+				return hoursOpen
+			}
+			if before > 0 && now.Before(p[0]) && !now.Add(before).Before(p[0]) {
+				result = hoursOpening
+			}
+		}
+	}
+
+	return result
+}
+
+// watchHours notifies hours each time the opening hours in the live configuration move the installation
+// into a different part of the day.
+func watchHours(live *LiveConfig, hours chan int) {
+	last := hoursOpen
+
+	for range time.Tick(time.Second) {
+		if h := hoursAt(live.get().Hours, time.Now()); h != last {
+			hours <- h
+			last = h
+		}
+	}
+}
+
+// validateHours checks the opening hours at path.
+func (e *ConfigErrors) validateHours(path string, h OpeningHours) {
+	period := func(p string, open string, close string) {
+		o, err := minuteOfDay(open)
+		if err != nil {
+			e.add(p+".Open", "%v", err)
+		}
+		c, err := minuteOfDay(close)
+		if err != nil {
+			e.add(p+".Close", "%v", err)
+		}
+		if o >= c {
+			e.add(p+".Close", "'%s' must be after opening at '%s'", close, open)
+		}
+	}
+
+	for i, w := range h.Weekly {
+		p := fmt.Sprintf("%s.Weekly[%d]", path, i)
+		e.oneOf(p+".Weekday", w.Weekday, "Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday")
+		period(p, w.Open, w.Close)
+	}
+
+	for i, d := range h.Exceptions {
+		p := fmt.Sprintf("%s.Exceptions[%d]", path, i)
+		if _, err := time.Parse("2006-01-02", d.Date); err != nil {
+			e.add(p+".Date", "'%s' is not a date, such as 2016-12-25", d.Date)
+		}
+		if d.Open != "" || d.Close != "" {
+			period(p, d.Open, d.Close)
+		}
+	}
+
+	e.atLeast(path+".PurgeDuration", float64(h.PurgeDuration), 0)
+	e.atLeast(path+".AttractBefore", float64(h.AttractBefore), 0)
+}
+
+// purgeFan runs the fan for duration milliseconds to clear the smoke chamber, once any fan run from the
+// last session has finished at the time clearAt.
+func purgeFan(pin uint8, duration int, clearAt time.Time, relayCtrl *RelayControl) {
+	if duration <= 0 {
+		return
+	}
+
+	time.Sleep(time.Until(clearAt))
+	log.Printf("INFO: Purging the smoke chamber")
+	if err := relayCtrl.enable(pin); err != nil {
+		log.Printf("ERROR: Unable to purge the smoke chamber: %v", err)
+		return
+	}
+	events.publish("fan", map[string]interface{}{"On": true})
+
+	time.Sleep(time.Millisecond * time.Duration(duration))
+	relayCtrl.disable(pin)
+	events.publish("fan", map[string]interface{}{"On": false})
+}
+
+// closeUp switches off the smoke, lights and pump for the night and purges the smoke chamber.
+func closeUp(state *WeatherMachine) {
+	state.dmx.SetChannel(1, 0)
+	disableLight(state.config, state.dmx)
+	state.relayCtrl.disable(state.config.I2CPinPump)
+	go purgeFan(state.config.I2CPinFan, state.config.Hours.PurgeDuration, state.clearAt, state.relayCtrl)
+}
+
+// changeHours moves the installation into the part of the day h. At closing time everything is wound
+// down and switched off, and the fan purges the smoke chamber. Closing during an emergency stop leaves
+// the purge till the stop is reset. While closed, skin contact is ignored.
+func changeHours(state *WeatherMachine, current stateFn, h int) stateFn {
+	wasOpen := !state.closed
+	wasAttracting := state.closed && state.opening
+
+	if wasOpen && h != hoursOpen {
+		log.Printf("INFO: Closing")
+		cancelTestSession(state)
+		if state.halted {
+			state.purge = true // The fan can't run till the emergency stop is reset.
+		} else {
+			windDown(state, current)
+			closeUp(state)
+		}
+	}
+	if h == hoursOpen {
+		state.purge = false // Open again before the emergency stop was reset, there is nothing to close up.
+	}
+
+	state.closed = h != hoursOpen
+	state.opening = h == hoursOpening
+
+	// The emergency stop holds everything off, the hours take effect once it is reset.
+	if state.halted {
+		return current
+	}
+
+	switch {
+	case h == hoursOpen && wasOpen:
+		return current
+
+	case h == hoursOpen:
+		log.Printf("INFO: Opening")
+		if !wasAttracting {
+			go enableAttract(state.live, state.attract, state.dmx)
+		}
+		return idle
+
+	case h == hoursOpening && !wasAttracting:
+		go enableAttract(state.live, state.attract, state.dmx)
+
+	case h == hoursClosed && wasAttracting:
+		stopAttract(state.attract)
+	}
+
+	return closed
+}
+
+// closed is the state the weathermachine enters outside of opening hours. Skin contact is ignored till
+// the venue opens again.
+func closed(state *WeatherMachine, msg HRMsg) stateFn {
+	return closed
+}
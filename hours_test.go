@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Opening hours", func() {
+	h := OpeningHours{
+		Weekly: []OpenPeriod{
+			{"Saturday", "10:00", "12:30"},
+			{"Saturday", "13:30", "17:00"},
+			{"Sunday", "10:00", "16:00"},
+		},
+		Exceptions: []OpenDate{
+			{"2016-03-13", "", ""},
+			{"2016-03-14", "12:00", "14:00"},
+		},
+		AttractBefore: 600000,
+	}
+	at := func(date string, clock string) time.Time {
+		t, _ := time.ParseInLocation("2006-01-02 15:04", date+" "+clock, time.Local)
+		return t
+	}
+
+	It("should always be open without any weekly hours", func() {
+		Ω(hoursAt(OpeningHours{}, at("2016-03-12", "03:00"))).Should(Equal(hoursOpen))
+	})
+
+	It("should only be open within the weekly hours", func() {
+		Ω(hoursAt(h, at("2016-03-12", "09:00"))).Should(Equal(hoursClosed))
+		Ω(hoursAt(h, at("2016-03-12", "09:55"))).Should(Equal(hoursOpening))
+		Ω(hoursAt(h, at("2016-03-12", "10:00"))).Should(Equal(hoursOpen))
+		Ω(hoursAt(h, at("2016-03-12", "12:30"))).Should(Equal(hoursClosed))
+		Ω(hoursAt(h, at("2016-03-12", "13:25"))).Should(Equal(hoursOpening))
+		Ω(hoursAt(h, at("2016-03-12", "16:59"))).Should(Equal(hoursOpen))
+		Ω(hoursAt(h, at("2016-03-12", "17:00"))).Should(Equal(hoursClosed))
+		Ω(hoursAt(h, at("2016-03-19", "11:00"))).Should(Equal(hoursOpen))
+	})
+
+	It("should replace the weekly hours with the hours for an exception", func() {
+		Ω(hoursAt(h, at("2016-03-13", "11:00"))).Should(Equal(hoursClosed)) // A Sunday, closed all day.
+		Ω(hoursAt(h, at("2016-03-14", "13:00"))).Should(Equal(hoursOpen))   // A Monday, opened specially.
+		Ω(hoursAt(h, at("2016-03-20", "11:00"))).Should(Equal(hoursOpen))
+	})
+
+	It("should honour exceptions without any weekly hours", func() {
+		e := OpeningHours{Exceptions: []OpenDate{{"2016-12-25", "", ""}, {"2016-12-26", "12:00", "14:00"}}}
+
+		Ω(hoursAt(e, at("2016-12-24", "23:59"))).Should(Equal(hoursOpen))
+		Ω(hoursAt(e, at("2016-12-25", "00:00"))).Should(Equal(hoursClosed))
+		Ω(hoursAt(e, at("2016-12-25", "12:00"))).Should(Equal(hoursClosed))
+		Ω(hoursAt(e, at("2016-12-26", "11:00"))).Should(Equal(hoursClosed))
+		Ω(hoursAt(e, at("2016-12-26", "13:00"))).Should(Equal(hoursOpen))
+		Ω(hoursAt(e, at("2016-12-26", "14:00"))).Should(Equal(hoursClosed))
+		Ω(hoursAt(e, at("2016-12-27", "00:00"))).Should(Equal(hoursOpen))
+
+		e.AttractBefore = 600000
+		Ω(hoursAt(e, at("2016-12-25", "23:55"))).Should(Equal(hoursClosed))
+		Ω(hoursAt(e, at("2016-12-26", "11:55"))).Should(Equal(hoursOpening))
+		Ω(hoursAt(e, at("2016-12-26", "23:55"))).Should(Equal(hoursOpening))
+	})
+
+	It("should report invalid hours by their path", func() {
+		e := ConfigErrors{}
+		e.validateHours("Hours", OpeningHours{
+			Weekly:     []OpenPeriod{{"Funday", "10:00", "09:00"}},
+			Exceptions: []OpenDate{{"2016-02-30", "", ""}},
+		})
+
+		Ω(e).Should(Equal(ConfigErrors{
+			"Hours.Weekly[0].Weekday: 'Funday' must be one of 'Sunday', 'Monday', 'Tuesday', 'Wednesday', 'Thursday', 'Friday', 'Saturday'",
+			"Hours.Weekly[0].Close: '09:00' must be after opening at '10:00'",
+			"Hours.Exceptions[0].Date: '2016-02-30' is not a date, such as 2016-12-25",
+		}))
+	})
+})
+
+var _ = Describe("Closing", func() {
+	var state WeatherMachine
+	var button *Input
+
+	BeforeEach(func() {
+		c := defaultConfiguration()
+		c.Reservoir.StateFile = ""
+		c.Hours.PurgeDuration = 50
+		state = WeatherMachine{attract: make(chan bool), config: c, live: NewLiveConfig(c),
+			dmx: NewFrameBuffer(nullOutput{}, 40), relayCtrl: NewRelayCtrl(nullBus{}),
+			water: NewWaterTracker(c.Reservoir, nil), clearAt: time.Now()}
+		button, _ = NewInput(InputPin{}, nil)
+
+		go enableAttract(state.live, state.attract, state.dmx)
+	})
+
+	fan := func() bool { return state.relayCtrl.on(state.config.I2CPinFan) }
+
+	It("should purge the smoke chamber at closing time", func() {
+		Ω(stateName(changeHours(&state, idle, hoursClosed))).Should(Equal("closed"))
+
+		Eventually(fan).Should(BeTrue())
+		Eventually(fan).Should(BeFalse())
+		Ω(attracting(state.attract)).Should(BeFalse())
+	})
+
+	It("should cancel a test session at closing time", func() {
+		hr := make(chan HRMsg)
+		startTestSession(&state, idle, 70, hr)
+
+		Ω(stateName(changeHours(&state, idle, hoursClosed))).Should(Equal("closed"))
+		Ω(state.testing).Should(BeNil())
+		Consistently(hr, "100ms").ShouldNot(Receive())
+	})
+
+	It("should purge once reset, when closing during an emergency stop", func() {
+		update := emergencyStop(&state, idle)
+		update = changeHours(&state, update, hoursClosed)
+		Ω(stateName(update)).Should(Equal("stopped"))
+		Consistently(fan, "100ms").Should(BeFalse())
+
+		update = resetEStop(&state, update, button)
+		Ω(stateName(update)).Should(Equal("closed"))
+		Eventually(fan).Should(BeTrue())
+		Eventually(fan).Should(BeFalse())
+		Ω(state.purge).Should(BeFalse())
+	})
+
+	It("should not purge when the venue opens again before the emergency stop is reset", func() {
+		update := emergencyStop(&state, idle)
+		update = changeHours(&state, update, hoursClosed)
+		update = changeHours(&state, update, hoursOpen)
+
+		Ω(stateName(resetEStop(&state, update, button))).Should(Equal("idle"))
+		Consistently(fan, "100ms").Should(BeFalse())
+		stopAttract(state.attract)
+	})
+})
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/kidoman/embd"
+)
+
+type InputPin struct {
+	Source    string // Where the input is wired; "gpio" for a Raspberry Pi pin, "expander" for an I2C expander or empty for none.
+	Pin       int    // The GPIO pin number, or the bit within the expander input register.
+	Address   byte   // The I2C address of the expander.
+	Register  byte   // The expander register holding the input.
+	ActiveLow bool   // Is the input active when it reads low?
+}
+
+// Input reads a single digital input, such as a switch, from a GPIO pin or an I2C expander.
+type Input struct {
+	pin  InputPin        // Where the input is wired.
+	bus  embd.I2CBus     // The I2C bus for expander inputs.
+	gpio embd.DigitalPin // The open GPIO pin for GPIO inputs.
+}
+
+// NewInput opens the input wired as described by pin. Expander inputs are read over bus.
+func NewInput(pin InputPin, bus embd.I2CBus) (*Input, error) {
+	i := &Input{pin: pin, bus: bus}
+
+	switch pin.Source {
+	case "":
+	case "expander":
+		if bus == nil {
+			return nil, fmt.Errorf("no I2C bus for expander input")
+		}
+	case "gpio":
+		if err := embd.InitGPIO(); err != nil {
+			return nil, err
+		}
+
+		g, err := embd.NewDigitalPin(pin.Pin)
+		if err != nil {
+			return nil, err
+		}
+		if err := g.SetDirection(embd.In); err != nil {
+			return nil, err
+		}
+		i.gpio = g
+	default:
+		return nil, fmt.Errorf("unknown input source '%s'", pin.Source)
+	}
+
+	return i, nil
+}
+
+// Enabled returns true if the input is wired up.
+func (i *Input) Enabled() bool {
+	return i != nil && i.pin.Source != ""
+}
+
+// Active returns true if the input is currently active. Inputs that are not wired up are never active.
+func (i *Input) Active() (bool, error) {
+	if !i.Enabled() {
+		return false, nil
+	}
+
+	high := false
+	switch i.pin.Source {
+	case "expander":
+		v, err := i.bus.ReadByteFromReg(i.pin.Address, i.pin.Register)
+		if err != nil {
+			return false, err
+		}
+		high = v&(byte(0x1)<<uint(i.pin.Pin)) != 0
+
+	case "gpio":
+		v, err := i.gpio.Read()
+		if err != nil {
+			return false, err
+		}
+		high = v == embd.High
+	}
+
+	return high != i.pin.ActiveLow, nil
+}
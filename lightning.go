@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+type Lightning struct {
+	Density     float32 // The average number of strikes per minute while running. 0 for none.
+	Intensity   int     // The dimmer level of the brightest flash in a strike. (0-255)
+	Temperature int     // The colour temperature of the flashes in Kelvin. (1000-40000)
+	MinFlashes  int     // The fewest flashes in a single strike.
+	MaxFlashes  int     // The most flashes in a single strike.
+	Seed        int64   // The seed for generating strikes. 0 seeds from the clock.
+	SpikeBPM    int     // The rise in heart rate between readings that triggers a strike. 0 for none.
+}
+
+// flash is a single flash of light within a lightning strike.
+type flash struct {
+	level float64       // The brightness of the flash. (0-1)
+	on    time.Duration // How long the flash lasts.
+	off   time.Duration // How long to wait in darkness after the flash.
+}
+
+// strike generates the sequence of flashes that make up a single lightning strike. The leading
+// flash is always the brightest, the return strokes that follow flicker at random lower levels.
+func strike(r *rand.Rand, l Lightning) []flash {
+	n := l.MinFlashes
+	if l.MaxFlashes > l.MinFlashes {
+		n += r.Intn(l.MaxFlashes - l.MinFlashes + 1)
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	s := make([]flash, n)
+	for i := range s {
+		s[i].level = 0.3 + 0.7*r.Float64()
+		s[i].on = time.Millisecond * time.Duration(20+r.Intn(60))
+		s[i].off = time.Millisecond * time.Duration(40+r.Intn(110))
+	}
+	s[0].level = 1.0
+
+	return s
+}
+
+// temperatureColour approximates the colour of a black body at the temperature k (Kelvin) for the
+// red, green and blue channels of the light.
+func temperatureColour(k int) LightColour {
+	t := math.Max(1000.0, math.Min(40000.0, float64(k))) / 100.0
+
+	var r, g, b float64
+	if t <= 66.0 {
+		r = 255.0
+		g = 99.4708025861*math.Log(t) - 161.1195681661
+	} else {
+		r = 329.698727446 * math.Pow(t-60.0, -0.1332047592)
+		g = 288.1221695283 * math.Pow(t-60.0, -0.0755148492)
+	}
+
+	switch {
+	case t >= 66.0:
+		b = 255.0
+	case t <= 19.0:
+		b = 0.0
+	default:
+		b = 138.5177312231*math.Log(t-10.0) - 305.0447927307
+	}
+
+	return LightColour{Red: clampChannel(r), Green: clampChannel(g), Blue: clampChannel(b)}
+}
+
+// playStrike flashes a single strike over the light. It returns false if it was interrupted by a
+// notification to stop on d.
+func playStrike(s []flash, l Lightning, d chan bool, dmx *FrameBuffer) bool {
+	defer clearOverlayLight(lightningLayer, dmx)
+
+	colour := temperatureColour(l.Temperature)
+	events.publish("lightning", map[string]interface{}{"Flashes": len(s), "Colour": colour})
+
+	for _, f := range s {
+		colour.Dimmer = clampChannel(float64(l.Intensity) * f.level)
+		overlayLight(lightningLayer, colour, dmx)
+
+		select {
+		case <-time.After(f.on):
+		case <-d:
+			return false
+		}
+
+		overlayLight(lightningLayer, LightColour{}, dmx)
+
+		select {
+		case <-time.After(f.off):
+		case <-d:
+			return false
+		}
+	}
+
+	return true
+}
+
+// enableLightning layers randomly timed lightning strikes over the heartbeat, at the density set in
+// the latest live configuration, as well as a strike whenever one is requested on trigger. Lightning
+// continues till being notified to stop on d.
+func enableLightning(live *LiveConfig, trigger chan bool, d chan bool, dmx *FrameBuffer) {
+	seed := live.get().Lightning.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	r := rand.New(rand.NewSource(seed))
+
+	step := time.Millisecond * 100
+	ticker := time.NewTicker(step)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c := live.get()
+			// Strikes arrive as a poisson process, with density strikes per minute.
+			if r.Float64() >= float64(c.Lightning.Density)*step.Minutes() {
+				continue
+			}
+			if !playStrike(strike(r, c.Lightning), c.Lightning, d, dmx) {
+				return
+			}
+
+		case <-trigger:
+			c := live.get()
+			if !playStrike(strike(r, c.Lightning), c.Lightning, d, dmx) {
+				return
+			}
+
+		case <-d:
+			return
+		}
+	}
+}
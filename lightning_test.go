@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"math/rand"
+)
+
+var _ = Describe("Lightning", func() {
+	l := Lightning{Density: 6, Intensity: 255, Temperature: 6500, MinFlashes: 2, MaxFlashes: 5, Seed: 42}
+
+	It("should generate the same strikes from the same seed", func() {
+		a := rand.New(rand.NewSource(l.Seed))
+		b := rand.New(rand.NewSource(l.Seed))
+
+		for i := 0; i < 10; i++ {
+			Ω(strike(a, l)).Should(Equal(strike(b, l)))
+		}
+	})
+
+	It("should lead each strike with the brightest flash", func() {
+		r := rand.New(rand.NewSource(l.Seed))
+
+		for i := 0; i < 10; i++ {
+			s := strike(r, l)
+			Ω(len(s)).Should(BeNumerically(">=", 2))
+			Ω(len(s)).Should(BeNumerically("<=", 5))
+			Ω(s[0].level).Should(Equal(1.0))
+		}
+	})
+
+	It("should warm the colour as the temperature drops", func() {
+		daylight := temperatureColour(6500)
+		candle := temperatureColour(1900)
+
+		Ω(daylight.Red).Should(BeNumerically(">", 240))
+		Ω(daylight.Blue).Should(BeNumerically(">", 240))
+		Ω(candle.Red).Should(Equal(255))
+		Ω(candle.Blue).Should(BeNumerically("<", 50))
+	})
+})
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// liveFields are the configuration fields that are safe to change in the middle of a session. They only
+// change how the effects look and feel, so the running effects pick them up straight away. Every other
+// field, such as pins and the session timeline, waits till the session has ended, apart from the
+// restartFields.
+var liveFields = map[string]bool{
+	"SmokeVolume":    true,
+	"SmokeDuration":  true,
+	"BeatRate":       true,
+	"S1Beat":         true,
+	"S1Duration":     true,
+	"S2Beat":         true,
+	"S2Duration":     true,
+	"S1Pause":        true,
+	"S1Envelope":     true,
+	"S2Envelope":     true,
+	"ColourMap":      true,
+	"AttractColour":  true,
+	"AttractFlash":   true,
+	"AttractPeriod":  true,
+	"AttractFlicker": true,
+	"Lightning":      true,
+	"Storm":          true,
+}
+
+// restartFields are the configuration fields for the hardware and servers that are only set up as the
+// installation starts. Changes to them are logged and ignored till the installation is restarted.
+var restartFields = map[string]bool{
+	"HRMMacAddress": true,
+	"SmokeAddress":  true,
+	"OutputMode":    true,
+	"SACNAddress":   true,
+	"SACNUniverse":  true,
+	"SACNPriority":  true,
+	"SACNSource":    true,
+	"FrameRate":     true,
+	"Reservoir":     true,
+	"EStop":         true,
+	"HTTPAddress":   true,
+	"EventOrigins":  true,
+}
+
+// LiveConfig shares the configuration with the effect goroutines, which read it each time they step
+// rather than holding on to the copy they were started with.
+type LiveConfig struct {
+	mu sync.RWMutex  // Guards c.
+	c  Configuration // The configuration the effects are currently using.
+}
+
+// NewLiveConfig creates a live configuration that starts out as c.
+func NewLiveConfig(c Configuration) *LiveConfig {
+	return &LiveConfig{c: c}
+}
+
+// get returns the configuration the effects should use right now.
+func (l *LiveConfig) get() Configuration {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.c
+}
+
+// set changes the configuration used by the effects.
+func (l *LiveConfig) set(c Configuration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.c = c
+}
+
+// mergeLive returns current with the live fields copied across from next.
+func mergeLive(current Configuration, next Configuration) Configuration {
+	merged := reflect.ValueOf(&current).Elem()
+	n := reflect.ValueOf(next)
+
+	for i := 0; i < merged.NumField(); i++ {
+		if liveFields[merged.Type().Field(i).Name] {
+			merged.Field(i).Set(n.Field(i))
+		}
+	}
+
+	return current
+}
+
+// keepRestartFields returns next with the restart fields copied across from current, logging any that
+// next would change.
+func keepRestartFields(current Configuration, next Configuration) Configuration {
+	kept := reflect.ValueOf(&next).Elem()
+	c := reflect.ValueOf(current)
+
+	ignored := []string{}
+	for i := 0; i < kept.NumField(); i++ {
+		name := kept.Type().Field(i).Name
+		if restartFields[name] && !reflect.DeepEqual(kept.Field(i).Interface(), c.Field(i).Interface()) {
+			ignored = append(ignored, name)
+			kept.Field(i).Set(c.Field(i))
+		}
+	}
+
+	if len(ignored) > 0 {
+		log.Printf("WARNING: Restart required to change %s", strings.Join(ignored, ", "))
+	}
+	return next
+}
+
+// applyConfiguration uses the configuration c within the installation. Outside of a session all of c
+// applies at once. During a session only the live fields apply, the rest is held back till the session
+// ends. The restart fields only change when the installation restarts.
+func applyConfiguration(state *WeatherMachine, c Configuration) {
+	c = keepRestartFields(state.config, c)
+
+	if !state.inSession {
+		state.config = c
+		state.pending = nil
+		state.live.set(c)
+		state.smoke.setBudget(c.SmokeBudget)
+		return
+	}
+
+	state.config = mergeLive(state.config, c)
+	state.live.set(state.config)
+
+	state.pending = nil
+	if deferred := diffConfiguration(state.config, c); len(deferred) > 0 {
+		state.pending = &c
+		log.Printf("INFO: Holding configuration changes till the session ends: %s", strings.Join(deferred, ", "))
+	}
+}
+
+// sessionEnded marks the end of a session, applying any configuration changes that were held back.
+func sessionEnded(state *WeatherMachine) {
+	state.inSession = false
+
+	if state.pending != nil {
+		log.Printf("INFO: Applying held configuration changes")
+		applyConfiguration(state, *state.pending)
+	}
+}
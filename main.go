@@ -22,14 +22,18 @@ package main
 import (
 	"bufio"
 	"flag"
+	"fmt"
 	"github.com/akualab/dmx"
 	"github.com/kidoman/embd"
 	_ "github.com/kidoman/embd/host/all"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -40,10 +44,12 @@ type HRMsg struct {
 
 // I2C
 type RelayControl struct {
+	mu      sync.Mutex // Guards regData and halted, relays are switched from several goroutines.
 	bus     embd.I2CBus
 	address byte
 	mode    byte
 	regData byte
+	halted  bool // Are the relays held open by an emergency stop?
 }
 
 func main() {
@@ -56,12 +62,25 @@ func main() {
 	log.Printf("INFO: Starting WeatherMachine2")
 
 	var configFile string
+	var overrideFile string
+	var refilled bool
 	flag.StringVar(&configFile, "configFile", "weather-machine.json", "The path to the configuration file")
+	flag.StringVar(&overrideFile, "overrideFile", "weather-machine.local.json", "The path to the local overrides for the configuration file")
+	flag.BoolVar(&refilled, "refilled", false, "Set when the water reservoir has just been refilled")
 	flag.Parse()
 
-	config, err := loadConfiguration(configFile)
-	if err != nil {
+	layers := configLayers{configFile, overrideFile, os.Environ()}
+	if flag.Arg(0) == "config" {
+		os.Exit(runConfigCommand(flag.Args()[1:], layers))
+	} else if flag.Arg(0) == "profile" {
+		os.Exit(runProfileCommand(flag.Args()[1:], layers))
+	}
+
+	config, err := loadLayers(layers)
+	if os.IsNotExist(err) {
 		log.Printf("INFO: Unable to open '%s', using default values", configFile)
+	} else if err != nil {
+		log.Printf("ERROR: Invalid configuration '%s', using default values: %v", configFile, err)
 	}
 
 	// Connect and initalise Raspberry Pi I2C
@@ -78,61 +97,192 @@ func main() {
 	// Reset relay
 	relayCtrl.bus.WriteByteToReg(relayCtrl.address, relayCtrl.mode, relayCtrl.regData)
 
+	levelSwitch, err := NewInput(config.Reservoir.LevelSwitch, bus)
+	if err != nil {
+		log.Printf("ERROR: Unable to open the reservoir level switch: %v", err)
+	}
+	water := NewWaterTracker(config.Reservoir, levelSwitch)
+	if refilled {
+		water.refilled()
+	}
+
+	// Walk through each output for the technicians, rather than running the installation.
+	if flag.Arg(0) == "selftest" {
+		if !selfTest(config, relayCtrl, water) {
+			embd.CloseI2C()
+			os.Exit(1)
+		}
+		return
+	}
+
 	// If we don't have the address of a heart rate monitor. Look for it.
 	if strings.Compare(config.HRMMacAddress, "0") == 0 {
 		log.Printf("INFO: Scanning for HRM.")
 		config.HRMMacAddress = scanHeartRateMonitor()
 		log.Printf("INFO: Found %s\n", config.HRMMacAddress)
-		saveConfiguration(configFile, config)
+
+		// Only the address belongs in the site file, not the local overrides or environment.
+		site, err := loadConfiguration(configFile)
+		if err == nil || os.IsNotExist(err) {
+			site.HRMMacAddress = config.HRMMacAddress
+			saveConfiguration(configFile, site)
+		}
 	}
 
 	// Connect to the DMX controller.
-	dmx, e := dmx.NewDMXConnection(config.SmokeAddress)
+	dmx, e := connectDMX(config)
 	if e != nil {
 		log.Printf("ERROR: Unable to connect to the DMX interface.")
 		return
 	}
 	defer dmx.Close()
 
+	frame := NewFrameBuffer(dmx, config.FrameRate)
+	refresh := make(chan bool)
+	go frame.refresh(refresh)
+
 	conf := make(chan Configuration)
 	hrMsg := make(chan HRMsg) // Channel for receiving heart rate messages from the PolarH7.
-	weatherMachine := WeatherMachine{make(chan bool), dmx, config, time.Now().Add(-time.Duration(config.FanDuration)), relayCtrl}
+	weatherMachine := WeatherMachine{
+		attract:   make(chan bool),
+		lightning: make(chan bool, 1),
+		cueHR:     make(chan int, 1),
+		pulseHR:   make(chan int, 1),
+		dmx:       frame,
+		smoke:     NewSmokeGovernor(config.SmokeBudget),
+		water:     water,
+		config:    config,
+		live:      NewLiveConfig(config),
+		clearAt:   time.Now(),
+		relayCtrl: relayCtrl,
+	}
 	update := idle
+	state := stateName(update)
+
+	// The emergency stop can be a physical button, or SIGUSR1 from software. SIGUSR2 resets it.
+	// SIGINT and SIGTERM switch everything off and exit.
+	button, err := NewInput(config.EStop, bus)
+	if err != nil {
+		log.Printf("ERROR: Unable to open the emergency stop button: %v", err)
+	}
+	estop := make(chan bool)
+	hours := make(chan int)
+	requests := make(chan apiRequest)
+	testHR := make(chan HRMsg)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM)
+	signals := make(chan os.Signal)
 
+	go enableAttract(weatherMachine.live, weatherMachine.attract, frame)
 	go pollHeartRateMonitor(config.HRMMacAddress, hrMsg)
-	go updateConfiguration(conf, configFile)
+	go updateConfiguration(conf, layers, config)
+	go watchEStop(button, estop, frame, relayCtrl)
+	go watchSignals(sig, signals, frame, relayCtrl)
+	go watchHours(weatherMachine.live, hours)
+	if config.HTTPAddress != "" {
+		go serveAPI(config.HTTPAddress, &apiServer{requests, testHR, layers, time.Now(), config.EventOrigins})
+	}
 	for {
-		msg := <-hrMsg
-
 		select {
+		case msg := <-hrMsg:
+			// A test session stands in for the heart rate monitor while it runs.
+			if weatherMachine.testing == nil {
+				weatherMachine.lastMsg = msg
+				events.publish("heartrate", msg)
+				update = update(&weatherMachine, msg)
+			}
+
+		case msg := <-testHR:
+			weatherMachine.lastMsg = msg
+			events.publish("heartrate", msg)
+			update = update(&weatherMachine, msg)
+
+		case r := <-requests:
+			update = r.do(&weatherMachine, update)
+			close(r.done)
+
 		case c := <-conf:
-			weatherMachine.config = c
 			// Use a new config within the weather machine if the configfile has been updated.
-		default:
-			// Don't need to do anything. Just don't block.
+			applyConfiguration(&weatherMachine, c)
+
+		case h := <-hours:
+			update = changeHours(&weatherMachine, update, h)
+
+		case <-estop:
+			update = emergencyStop(&weatherMachine, update)
+
+		case <-weatherMachine.cleared:
+			// The fog has cleared for the session waiting in warmup.
+			weatherMachine.cleared = nil
+			update = update(&weatherMachine, weatherMachine.lastMsg)
+
+		case s := <-signals:
+			switch s {
+			case syscall.SIGUSR1:
+				update = emergencyStop(&weatherMachine, update)
+			case syscall.SIGUSR2:
+				update = resetEStop(&weatherMachine, update, button)
+			default:
+				shutdown(&weatherMachine, update, refresh)
+				f.Sync()
+				return // Deferred closes of the DMX, I2C and log tidy up the rest.
+			}
+		}
+
+		if s := stateName(update); s != state {
+			events.publish("state", map[string]interface{}{"State": s, "From": state})
+			state = s
 		}
+	}
+}
 
-		update = update(&weatherMachine, msg)
+// connectDMX opens the DMX output selected by OutputMode in the configuration.
+func connectDMX(c Configuration) (DMXOutput, error) {
+	if c.OutputMode == "sacn" {
+		return NewSACNConnection(c.SACNAddress, c.SACNUniverse, c.SACNPriority, c.SACNSource)
 	}
+
+	return dmx.NewDMXConnection(c.SmokeAddress)
 }
 
 func NewRelayCtrl(bus embd.I2CBus) *RelayControl {
 	return &RelayControl{bus: bus, address: 0x20, mode: 0x06, regData: 0xff}
 }
 
-func updateConfiguration(c chan Configuration, configFile string) {
-	ticker := time.NewTicker(time.Second * 30).C
+// enable switches on the relay connected to pin.
+func (r *RelayControl) enable(pin uint8) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	for {
-		select {
-		case <-ticker:
-			config, err := loadConfiguration(configFile)
-			if err != nil {
-				log.Printf("INFO: Unable to open '%s', using default values", configFile)
-			}
-			c <- config
-		}
+	if r.halted {
+		return fmt.Errorf("relays halted by emergency stop")
 	}
+
+	r.regData &= ^(byte(0x1) << pin)
+	return r.bus.WriteByteToReg(r.address, r.mode, r.regData)
+}
+
+// disable switches off the relay connected to pin.
+func (r *RelayControl) disable(pin uint8) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.regData |= (byte(0x1) << pin)
+	return r.bus.WriteByteToReg(r.address, r.mode, r.regData)
+}
+
+// halt opens every relay and holds them open, or releases them again, for an emergency stop.
+func (r *RelayControl) halt(h bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.halted = h
+	if !h {
+		return nil
+	}
+
+	r.regData = 0xff
+	return r.bus.WriteByteToReg(r.address, r.mode, r.regData)
 }
 
 func scanHeartRateMonitor() string {
@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// configVersion is the version of the current layout of the configuration.
+const configVersion = 1
+
+type migration struct {
+	description string                                       // What the migration changes, for the log.
+	apply       func(fields map[string]json.RawMessage) bool // Upgrades the fields, returning true if anything changed.
+}
+
+// migrations upgrade the configuration from each version to the next. The first upgrades version 0 to
+// version 1 and so on, so there must always be configVersion of them.
+var migrations = []migration{
+	{"renamed GPIOPinFan, GPIOPinPump and GPIOPinLight to I2CPinFan, I2CPinPump and I2CPinLight", renameFields(map[string]string{
+		"GPIOPinFan":   "I2CPinFan",
+		"GPIOPinPump":  "I2CPinPump",
+		"GPIOPinLight": "I2CPinLight",
+	})},
+}
+
+// findField returns the name of the key in fields that matches name, ignoring case like decoding does.
+func findField(fields map[string]json.RawMessage, name string) (string, bool) {
+	for key := range fields {
+		if strings.EqualFold(key, name) {
+			return key, true
+		}
+	}
+
+	return "", false
+}
+
+// renameFields returns a migration that renames the top level fields named by the keys of renames to
+// their values. When a file already has a field under its new name as well, the new name wins.
+func renameFields(renames map[string]string) func(map[string]json.RawMessage) bool {
+	return func(fields map[string]json.RawMessage) bool {
+		changed := false
+		for from, to := range renames {
+			old, ok := findField(fields, from)
+			if !ok {
+				continue
+			}
+
+			if _, exists := findField(fields, to); !exists {
+				fields[to] = fields[old]
+			}
+			delete(fields, old)
+			changed = true
+		}
+
+		return changed
+	}
+}
+
+// migrate upgrades the JSON configuration b to the current version, returning it along with the
+// description of each migration applied. A file without a Version is version 0. Configurations that
+// are already current, or without a Version that no migration changes, are returned untouched.
+func migrate(b []byte) ([]byte, []string) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(b, &fields) != nil || fields == nil {
+		return b, nil // Let decoding report what is wrong with it.
+	}
+
+	version := 0
+	key, stated := findField(fields, "Version")
+	if stated {
+		if json.Unmarshal(fields[key], &version) != nil || version < 0 || version >= configVersion {
+			return b, nil // Validation reports versions that can't be migrated.
+		}
+		delete(fields, key)
+	}
+
+	applied := []string{}
+	for ; version < configVersion; version++ {
+		if m := migrations[version]; m.apply(fields) {
+			applied = append(applied, fmt.Sprintf("from version %d to %d, %s", version, version+1, m.description))
+		}
+	}
+
+	if !stated && len(applied) == 0 {
+		return b, nil
+	}
+
+	fields["Version"] = json.RawMessage(strconv.Itoa(configVersion))
+	migrated, err := json.Marshal(fields)
+	if err != nil {
+		return b, nil
+	}
+	return migrated, applied
+}
+
+// migrateName returns the current name of the top level field that was called name in an older
+// layout of the configuration, and true if it has been renamed.
+func migrateName(name string) (string, bool) {
+	fields := map[string]json.RawMessage{name: json.RawMessage("null")}
+	for _, m := range migrations {
+		m.apply(fields)
+	}
+
+	for key := range fields {
+		if len(fields) == 1 && key != name {
+			return key, true
+		}
+	}
+	return name, false
+}
+
+// noted remembers the older layouts that have already been noted in the log.
+var noted = struct {
+	sync.Mutex
+	sources map[string]bool
+}{sources: map[string]bool{}}
+
+// noteMigration logs, once per run, that the configuration from source uses an older layout that is
+// migrated each time it loads. The source itself is left as it is.
+func noteMigration(source string, applied []string) {
+	if len(applied) == 0 {
+		return
+	}
+
+	noted.Lock()
+	defer noted.Unlock()
+
+	if noted.sources[source] {
+		return
+	}
+	noted.sources[source] = true
+	log.Printf("INFO: '%s' uses an older layout, migrating it as it loads (%s). 'config convert' writes an updated copy", source, strings.Join(applied, "; "))
+}
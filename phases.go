@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Phase is a stage of a session. Any scale left out of the configuration for a phase is 1.
+type Phase struct {
+	Name       string  // The name of the phase, used when logging.
+	Start      int     // The number of milliseconds after skin contact that the phase begins.
+	SmokeScale float32 // Multiplier for the smoke volume during the phase. 0 for no smoke.
+	RainScale  float32 // Multiplier for the length of pump bursts during the phase. 0 for no rain.
+	LightScale float32 // Multiplier for the brightness of the heartbeat during the phase. 0 for darkness.
+	PaceScale  float32 // Multiplier for the time between smoke puffs and pump bursts during the phase.
+}
+
+// fullPhase is the phase a session is in when the configuration has no phases; everything as configured.
+var fullPhase = Phase{Name: "full", SmokeScale: 1.0, RainScale: 1.0, LightScale: 1.0, PaceScale: 1.0}
+
+// UnmarshalJSON reads a phase from the configuration. Scales left out of the phase run as configured,
+// rather than falling to 0 and switching their effect off.
+func (p *Phase) UnmarshalJSON(b []byte) error {
+	type phase Phase // Without the UnmarshalJSON method, to avoid recursing.
+
+	ph := phase(fullPhase)
+	ph.Name = ""
+	if err := json.Unmarshal(b, &ph); err != nil {
+		return err
+	}
+
+	*p = Phase(ph)
+	return nil
+}
+
+// phaseAt returns the phase of a session elapsed time after skin contact. This is the phase with the
+// latest start that has already begun.
+func phaseAt(phases []Phase, elapsed time.Duration) Phase {
+	p := fullPhase
+	started := time.Duration(-1)
+
+	for _, ph := range phases {
+		s := time.Millisecond * time.Duration(ph.Start)
+		if s <= elapsed && s > started {
+			p = ph
+			started = s
+		}
+	}
+
+	return p
+}
+
+// sessionExpired returns true if a session that started at start has run past the maximum session
+// length in the configuration.
+func sessionExpired(c Configuration, start time.Time) bool {
+	return c.MaxSession > 0 && time.Since(start) >= time.Millisecond*time.Duration(c.MaxSession)
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Phases", func() {
+	phases := []Phase{{Name: "calm", Start: 60000}, {Name: "build", Start: 0}, {Name: "peak", Start: 30000}}
+
+	It("should run at full intensity without phases", func() {
+		Ω(phaseAt(nil, time.Minute)).Should(Equal(fullPhase))
+	})
+
+	It("should run scales left out of a phase as configured", func() {
+		var ph []Phase
+		Ω(json.Unmarshal([]byte(`[{"Name":"dark", "Start":1000, "LightScale":0, "RainScale":0.5}]`), &ph)).Should(BeNil())
+
+		Ω(ph[0].Name).Should(Equal("dark"))
+		Ω(ph[0].Start).Should(Equal(1000))
+		Ω(ph[0].LightScale).Should(BeNumerically("==", 0))
+		Ω(ph[0].RainScale).Should(BeNumerically("==", 0.5))
+		Ω(ph[0].SmokeScale).Should(BeNumerically("==", 1))
+		Ω(ph[0].PaceScale).Should(BeNumerically("==", 1))
+	})
+
+	It("should refuse negative scales", func() {
+		c := defaultConfiguration()
+		c.Phases = []Phase{{Name: "odd", SmokeScale: -1, RainScale: 1, LightScale: -0.5, PaceScale: 1}}
+		err := validateConfiguration(c)
+
+		Ω(err).ShouldNot(BeNil())
+		Ω(err.Error()).Should(ContainSubstring("Phases[0].SmokeScale"))
+		Ω(err.Error()).Should(ContainSubstring("Phases[0].LightScale"))
+		Ω(err.Error()).ShouldNot(ContainSubstring("Phases[0].RainScale"))
+	})
+
+	It("should pick the latest phase that has begun", func() {
+		Ω(phaseAt(phases, 0).Name).Should(Equal("build"))
+		Ω(phaseAt(phases, 45*time.Second).Name).Should(Equal("peak"))
+		Ω(phaseAt(phases, 5*time.Minute).Name).Should(Equal("calm"))
+	})
+
+	It("should only expire sessions with a maximum length", func() {
+		start := time.Now().Add(-time.Minute)
+
+		Ω(sessionExpired(Configuration{}, start)).Should(BeFalse())
+		Ω(sessionExpired(Configuration{MaxSession: 30000}, start)).Should(BeTrue())
+		Ω(sessionExpired(Configuration{MaxSession: 90000}, start)).Should(BeFalse())
+	})
+})
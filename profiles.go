@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+type ProfileSlot struct {
+	At      string // The time of day to switch profile, such as "18:30".
+	Profile string // The name of the profile to switch to. Empty to run without a profile.
+}
+
+// minuteOfDay parses the time of day at, in the form "15:04", into the number of minutes since midnight.
+func minuteOfDay(at string) (int, error) {
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a time of day, such as 18:30", at)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// scheduledProfile returns the name of the profile the schedule has running at the time now. Before the
+// first slot of the day, the last slot from the day before is still running.
+func scheduledProfile(schedule []ProfileSlot, now time.Time) string {
+	minute := now.Hour()*60 + now.Minute()
+	profile := ""
+	best, latest := -1, -1
+
+	for _, s := range schedule {
+		m, err := minuteOfDay(s.At)
+		if err != nil {
+			continue
+		}
+
+		if m <= minute && m > best {
+			best = m
+			profile = s.Profile
+		}
+		if best < 0 && m > latest {
+			latest = m
+			profile = s.Profile
+		}
+	}
+
+	return profile
+}
+
+// activeProfile returns the name of the profile c runs with at the time now. A profile chosen by hand
+// wins over the schedule.
+func activeProfile(c Configuration, now time.Time) string {
+	if c.Profile != "" {
+		return c.Profile
+	}
+
+	return scheduledProfile(c.ProfileSchedule, now)
+}
+
+// nextSlot returns the next time after now that the schedule switches profile, or the zero time if
+// there is no schedule.
+func nextSlot(schedule []ProfileSlot, now time.Time) time.Time {
+	next := time.Time{}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	for _, s := range schedule {
+		m, err := minuteOfDay(s.At)
+		if err != nil {
+			continue
+		}
+
+		t := midnight.Add(time.Minute * time.Duration(m))
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+
+	return next
+}
+
+// profileNames returns the names of every profile in c, sorted.
+func profileNames(c Configuration) []string {
+	names := []string{}
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// useProfile switches the installation to the named profile, or back to the schedule when name is
+// empty. The choice is written to the local overrides file, where the running installation picks it up.
+func useProfile(layers configLayers, name string) error {
+	if layers.local == "" {
+		return fmt.Errorf("no local overrides file to record the profile in")
+	}
+
+	c, err := loadLayers(layers)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, ok := c.Profiles[name]; name != "" && !ok {
+		return fmt.Errorf("unknown profile '%s'", name)
+	}
+
+	local := defaultConfiguration()
+	b, err := readLayer(layers.local)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(b) > 0 {
+		if err = json.Unmarshal(b, &local); err != nil {
+			return err
+		}
+	}
+
+	local.Profile = name
+	return saveConfiguration(layers.local, local)
+}
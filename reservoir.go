@@ -0,0 +1,273 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+)
+
+type Reservoir struct {
+	Capacity    float32  // The number of millilitres of water in a full reservoir. 0 to not track water use.
+	FlowRate    float32  // The number of millilitres the pump moves every second.
+	RefillLevel float32  // The number of millilitres left at which the reservoir needs a refill.
+	LevelSwitch InputPin // The switch that is active when the water is too low to pump.
+	StateFile   string   // The file that keeps track of water used across restarts.
+}
+
+// ReservoirStatus describes how much water is left for the pump.
+type ReservoirStatus struct {
+	Used         float32 // The number of millilitres pumped since the last refill.
+	Remaining    float32 // The estimated number of millilitres left in the reservoir.
+	LevelLow     bool    // Is the level switch reporting low water?
+	RefillNeeded bool    // Does someone need to refill the reservoir?
+}
+
+// levelCheck is how often the level switch is checked while the pump is running.
+const levelCheck = 100 * time.Millisecond
+
+// WaterTracker estimates the water left in the reservoir from how long the pump has run, and
+// stops the pump from running dry.
+type WaterTracker struct {
+	mu      sync.Mutex // Guards used, warned, pumping, pumpOn and pumpOff.
+	res     Reservoir  // The reservoir being tracked.
+	level   *Input     // The level switch, if there is one.
+	used    float32    // The number of millilitres pumped since the last refill.
+	warned  bool       // Has the need for a refill been logged?
+	pumping bool       // Is a burst of the pump running?
+	pumpOn  time.Time  // When the running burst switched the pump on.
+	pumpOff time.Time  // When the running burst, including any overlapping bursts, switches the pump off.
+}
+
+// NewWaterTracker creates a tracker for the reservoir r, carrying on from the water used in its state
+// file.
+func NewWaterTracker(r Reservoir, level *Input) *WaterTracker {
+	w := &WaterTracker{res: r, level: level}
+
+	if r.StateFile != "" {
+		if b, err := ioutil.ReadFile(r.StateFile); err == nil {
+			var s ReservoirStatus
+			if json.Unmarshal(b, &s) == nil {
+				w.used = s.Used
+			}
+		}
+	}
+
+	return w
+}
+
+// status returns the current state of the reservoir. It must be called with mu held.
+func (w *WaterTracker) status() ReservoirStatus {
+	s := ReservoirStatus{Used: w.used, Remaining: w.res.Capacity - w.used}
+
+	if low, err := w.level.Active(); err != nil {
+		log.Printf("ERROR: Unable to read the reservoir level switch")
+	} else {
+		s.LevelLow = low
+	}
+
+	s.RefillNeeded = s.LevelLow || (w.res.Capacity > 0 && s.Remaining <= w.res.RefillLevel)
+	return s
+}
+
+// Status returns the current state of the reservoir.
+func (w *WaterTracker) Status() ReservoirStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.status()
+}
+
+// canPump returns true if there is enough water to run the pump. The need for a refill is logged the
+// first time it is noticed.
+func (w *WaterTracker) canPump() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.pumpable()
+}
+
+// pumpable is canPump for when mu is already held.
+func (w *WaterTracker) pumpable() bool {
+	s := w.status()
+	if s.RefillNeeded && !w.warned {
+		log.Printf("WARNING: Reservoir refill needed, %.0fml remaining", s.Remaining)
+	}
+	w.warned = s.RefillNeeded
+
+	return !s.LevelLow && (w.res.Capacity <= 0 || s.Remaining > 0)
+}
+
+// pumped records that the pump ran for d.
+func (w *WaterTracker) pumped(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.used += w.res.FlowRate * float32(d.Seconds())
+	w.save()
+}
+
+// refilled records that the reservoir has been filled up.
+func (w *WaterTracker) refilled() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.used = 0
+	w.warned = false
+	w.save()
+	log.Printf("INFO: Reservoir refilled")
+}
+
+// save writes the water used to the state file. It must be called with mu held.
+func (w *WaterTracker) save() {
+	if w.res.StateFile == "" || w.res.Capacity <= 0 {
+		return // Water use isn't being tracked.
+	}
+
+	b, _ := json.Marshal(ReservoirStatus{Used: w.used})
+	if err := ioutil.WriteFile(w.res.StateFile, b, 0666); err != nil {
+		log.Printf("ERROR: Unable to save the reservoir state")
+	}
+}
+
+// startBurst asks to run the pump for d. A burst that starts while another is running extends it,
+// otherwise the pump is switched on with switchOn. No burst runs past the water left in the reservoir.
+// It returns the time the burst ends, and false if the pump isn't running for it; there is no water to
+// pump or the pump couldn't be switched on.
+func (w *WaterTracker) startBurst(d time.Duration, switchOn func() error) (off time.Time, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.pumpable() {
+		return time.Time{}, false
+	}
+
+	now := time.Now()
+	on := now
+	if w.pumping {
+		on = w.pumpOn
+	}
+
+	off = now.Add(d)
+	if w.res.Capacity > 0 && w.res.FlowRate > 0 {
+		left := time.Duration(float64(w.res.Capacity-w.used) / float64(w.res.FlowRate) * float64(time.Second))
+		if empty := on.Add(left); off.After(empty) {
+			log.Printf("WARNING: Reservoir nearly empty, cutting the pump burst short")
+			off = empty
+		}
+	}
+	if !off.After(now) {
+		return time.Time{}, false
+	}
+
+	if !w.pumping {
+		if err := switchOn(); err != nil {
+			return time.Time{}, false
+		}
+		w.pumping = true
+		w.pumpOn = now
+		w.pumpOff = off
+		return off, true
+	}
+
+	if off.After(w.pumpOff) {
+		w.pumpOff = off
+	}
+	return off, true
+}
+
+// checkBurst checks on the burst due to end at off while the pump is running, cutting it short if
+// the pump relay is no longer on or the level switch reports low water. It returns the time the burst
+// now ends.
+func (w *WaterTracker) checkBurst(off time.Time, relayOn bool) time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.pumping {
+		return off
+	}
+
+	if !relayOn {
+		w.pumpOff = time.Now() // Switched off underneath us, such as by the emergency stop.
+		return w.pumpOff
+	}
+
+	if !w.level.Enabled() {
+		return off
+	}
+
+	if low, err := w.level.Active(); err == nil && low {
+		log.Printf("WARNING: Reservoir level low, stopping the pump")
+		w.pumpOff = time.Now()
+		return w.pumpOff
+	}
+
+	return off
+}
+
+// endBurst finishes a burst of the pump that was due to end at off. It returns true if the pump needs
+// switching off, which is only once the last of any overlapping bursts has ended. The water used is
+// recorded for the time the pump ran.
+func (w *WaterTracker) endBurst(off time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.pumping || off.Before(w.pumpOff) {
+		return false // Another burst is still running the pump.
+	}
+
+	w.pumping = false
+	w.used += w.res.FlowRate * float32(w.pumpOff.Sub(w.pumpOn).Seconds())
+	w.save()
+	return true
+}
+
+// pulsePump runs the pump connected to the relay on pin for duration milliseconds, as long as the
+// water tracker 'w' says there is water to pump. Bursts that overlap keep the pump running till the
+// last of them ends. The pump stops early if the level switch reports low water, or the relay is switched
+// off underneath it by the emergency stop.
+func pulsePump(pin uint8, duration int, w *WaterTracker, relayCtrl *RelayControl) {
+	off, ok := w.startBurst(time.Millisecond*time.Duration(duration), func() error {
+		if err := relayCtrl.enable(pin); err != nil {
+			return err
+		}
+		events.publish("pump", map[string]interface{}{"On": true})
+		return nil
+	})
+	if !ok {
+		return // Never run the pump dry or while the relays are halted.
+	}
+
+	for wait := time.Until(off); wait > 0; wait = time.Until(off) {
+		if wait > levelCheck {
+			wait = levelCheck
+		}
+		time.Sleep(wait)
+		off = w.checkBurst(off, relayCtrl.on(pin))
+	}
+
+	if w.endBurst(off) {
+		relayCtrl.disable(pin)
+		events.publish("pump", map[string]interface{}{"On": false})
+	}
+}
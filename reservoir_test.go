@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// switchBus is an I2C bus with a single expander input register, that can be flipped by the test.
+type switchBus struct {
+	nullBus
+	value int32 // The value of the input register.
+}
+
+func (b *switchBus) ReadByteFromReg(addr, reg byte) (byte, error) {
+	return byte(atomic.LoadInt32(&b.value)), nil
+}
+
+func (b *switchBus) set(v byte) {
+	atomic.StoreInt32(&b.value, int32(v))
+}
+
+var _ = Describe("Reservoir", func() {
+	var dir string
+	var relayCtrl *RelayControl
+	pin := uint8(3)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "reservoir")
+		Ω(err).Should(BeNil())
+		relayCtrl = NewRelayCtrl(nullBus{})
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should carry the water used across restarts", func() {
+		r := Reservoir{Capacity: 1000, FlowRate: 10, RefillLevel: 100, StateFile: filepath.Join(dir, "water")}
+		NewWaterTracker(r, nil).pumped(30 * time.Second)
+
+		s := NewWaterTracker(r, nil).Status()
+		Ω(s.Used).Should(BeNumerically("~", 300, 0.01))
+		Ω(s.Remaining).Should(BeNumerically("~", 700, 0.01))
+		Ω(s.RefillNeeded).Should(BeFalse())
+	})
+
+	It("should not save anything when water use isn't tracked", func() {
+		r := Reservoir{Capacity: 0, FlowRate: 10, StateFile: filepath.Join(dir, "water")}
+		w := NewWaterTracker(r, nil)
+		w.pumped(30 * time.Second)
+		w.refilled()
+
+		_, err := os.Stat(r.StateFile)
+		Ω(os.IsNotExist(err)).Should(BeTrue())
+		Ω(w.canPump()).Should(BeTrue())
+	})
+
+	It("should need a refill at the refill level and stop pumping once empty", func() {
+		w := NewWaterTracker(Reservoir{Capacity: 1000, FlowRate: 10, RefillLevel: 100}, nil)
+
+		w.pumped(85 * time.Second)
+		Ω(w.Status().RefillNeeded).Should(BeFalse())
+
+		w.pumped(10 * time.Second)
+		Ω(w.Status().RefillNeeded).Should(BeTrue())
+		Ω(w.canPump()).Should(BeTrue())
+
+		w.pumped(5 * time.Second)
+		Ω(w.canPump()).Should(BeFalse())
+
+		w.refilled()
+		Ω(w.Status().Used).Should(BeNumerically("==", 0))
+		Ω(w.canPump()).Should(BeTrue())
+	})
+
+	It("should trim a burst to the water left", func() {
+		w := NewWaterTracker(Reservoir{Capacity: 1000, FlowRate: 10}, nil)
+		w.pumped(99950 * time.Millisecond) // 0.5ml left, 50ms of pumping.
+
+		start := time.Now()
+		pulsePump(pin, 1000, w, relayCtrl)
+
+		Ω(time.Since(start)).Should(BeNumerically("<", 500*time.Millisecond))
+		Ω(relayCtrl.on(pin)).Should(BeFalse())
+		Ω(w.Status().Remaining).Should(BeNumerically("~", 0, 0.2))
+		Ω(w.canPump()).Should(BeFalse())
+	})
+
+	It("should stop the pump as soon as the level switch reports low water", func() {
+		bus := &switchBus{}
+		level, err := NewInput(InputPin{Source: "expander", Pin: 0, Address: 0x21}, bus)
+		Ω(err).Should(BeNil())
+		w := NewWaterTracker(Reservoir{}, level)
+
+		done := make(chan bool)
+		go func() {
+			pulsePump(pin, 5000, w, relayCtrl)
+			close(done)
+		}()
+		Eventually(func() bool { return relayCtrl.on(pin) }).Should(BeTrue())
+
+		bus.set(1)
+		Eventually(done, "1s").Should(BeClosed())
+		Ω(relayCtrl.on(pin)).Should(BeFalse())
+		Ω(w.canPump()).Should(BeFalse())
+	})
+
+	It("should not pump or count water while the relays are halted", func() {
+		w := NewWaterTracker(Reservoir{Capacity: 1000, FlowRate: 10}, nil)
+		sub := events.subscribe()
+		defer events.unsubscribe(sub)
+		relayCtrl.halt(true)
+
+		start := time.Now()
+		pulsePump(pin, 1000, w, relayCtrl)
+
+		Ω(time.Since(start)).Should(BeNumerically("<", 100*time.Millisecond))
+		Ω(w.Status().Used).Should(BeNumerically("==", 0))
+		Ω(sub).Should(BeEmpty())
+	})
+
+	It("should only count water for the time the pump ran before being halted", func() {
+		w := NewWaterTracker(Reservoir{Capacity: 1000, FlowRate: 10}, nil)
+
+		done := make(chan bool)
+		go func() {
+			pulsePump(pin, 5000, w, relayCtrl)
+			close(done)
+		}()
+		time.Sleep(200 * time.Millisecond)
+		relayCtrl.halt(true)
+
+		Eventually(done, "1s").Should(BeClosed())
+		Ω(w.Status().Used).Should(BeNumerically("~", 2, 1.1))
+	})
+})
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	sacnPort       = 5568 // The UDP port reserved for E1.31 traffic.
+	sacnPacketSize = 638  // The size of a data packet carrying a full 512 channel universe.
+)
+
+// DMXOutput is something that the installation can write DMX channel values to. Both the USB DMX
+// controller and the sACN sender satisfy it.
+type DMXOutput interface {
+	SetChannel(channel int, val byte) error
+	Render() error
+	Close() error
+}
+
+// SACN sends a single DMX universe over the network using the E1.31 (streaming ACN) protocol.
+type SACN struct {
+	conn       *net.UDPConn // The UDP socket that frames are written to.
+	cid        [16]byte     // The component identifier that lighting desks use to track this source.
+	sourceName string       // The human readable name of this source.
+	priority   byte         // The priority of this source. (0-200)
+	universe   uint16       // The universe that frames are sent on. (1-63999)
+	sequence   byte         // The sequence number of the next frame.
+	frame      [512]byte    // The channel values to send on the next render.
+}
+
+// NewSACNConnection creates an sACN sender for the supplied universe. If address is empty frames are
+// multicast to the standard group for the universe, otherwise they are unicast to address.
+func NewSACNConnection(address string, universe uint16, priority byte, sourceName string) (*SACN, error) {
+	if universe < 1 || universe > 63999 {
+		return nil, fmt.Errorf("sACN universe %d out of range (1-63999)", universe)
+	}
+
+	if address == "" {
+		address = sacnMulticastAddress(universe)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, strconv.Itoa(sacnPort))
+	}
+
+	dst, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP("udp", nil, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newSACN(universe, priority, sourceName)
+	s.conn = conn
+	return s, nil
+}
+
+// newSACN creates an unconnected sACN sender, the component identifier is derived from the source name
+// so that it remains stable across restarts.
+func newSACN(universe uint16, priority byte, sourceName string) *SACN {
+	cid := md5.Sum([]byte(sourceName))
+	cid[6] = (cid[6] & 0x0f) | 0x30 // Name based UUID (version 3).
+	cid[8] = (cid[8] & 0x3f) | 0x80 // RFC 4122 variant.
+
+	return &SACN{cid: cid, sourceName: sourceName, priority: priority, universe: universe}
+}
+
+// sacnMulticastAddress returns the multicast group that receivers listen on for universe.
+func sacnMulticastAddress(universe uint16) string {
+	return fmt.Sprintf("239.255.%d.%d:%d", universe>>8, universe&0xff, sacnPort)
+}
+
+// SetChannel sets the value of the DMX channel (1-512) for the next render.
+func (s *SACN) SetChannel(channel int, val byte) error {
+	if channel < 1 || channel > 512 {
+		return fmt.Errorf("DMX channel %d out of range (1-512)", channel)
+	}
+
+	s.frame[channel-1] = val
+	return nil
+}
+
+// Render sends the current frame to the network.
+func (s *SACN) Render() error {
+	_, err := s.conn.Write(s.packet())
+	s.sequence++
+	return err
+}
+
+// Close closes the underlying network connection.
+func (s *SACN) Close() error {
+	return s.conn.Close()
+}
+
+// packet builds an E1.31 data packet containing the current frame.
+func (s *SACN) packet() []byte {
+	p := make([]byte, sacnPacketSize)
+
+	// Root layer.
+	binary.BigEndian.PutUint16(p[0:], 0x0010) // Preamble size.
+	binary.BigEndian.PutUint16(p[2:], 0x0000) // Post-amble size.
+	copy(p[4:16], "ASC-E1.17\x00\x00\x00")
+	binary.BigEndian.PutUint16(p[16:], 0x7000|uint16(sacnPacketSize-16))
+	binary.BigEndian.PutUint32(p[18:], 0x00000004) // VECTOR_ROOT_E131_DATA
+	copy(p[22:38], s.cid[:])
+
+	// Framing layer.
+	binary.BigEndian.PutUint16(p[38:], 0x7000|uint16(sacnPacketSize-38))
+	binary.BigEndian.PutUint32(p[40:], 0x00000002) // VECTOR_E131_DATA_PACKET
+	copy(p[44:107], s.sourceName)                  // Null terminated, so at most 63 bytes.
+	p[108] = s.priority
+	binary.BigEndian.PutUint16(p[109:], 0) // Synchronization address, unused.
+	p[111] = s.sequence
+	p[112] = 0 // Options.
+	binary.BigEndian.PutUint16(p[113:], s.universe)
+
+	// DMP layer.
+	binary.BigEndian.PutUint16(p[115:], 0x7000|uint16(sacnPacketSize-115))
+	p[117] = 0x02                             // VECTOR_DMP_SET_PROPERTY
+	p[118] = 0xa1                             // Address type and data type.
+	binary.BigEndian.PutUint16(p[119:], 0x00) // First property address.
+	binary.BigEndian.PutUint16(p[121:], 0x01) // Address increment.
+	binary.BigEndian.PutUint16(p[123:], 513)  // Property value count, start code plus channels.
+	p[125] = 0x00                             // DMX start code.
+	copy(p[126:], s.frame[:])
+
+	return p
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+var _ = Describe("sACN", func() {
+	Context("packets", func() {
+		It("should match the reference frame for a multicast universe", func() {
+			ref, err := ioutil.ReadFile("testdata/sacn-universe1.bin")
+			Ω(err).Should(BeNil())
+
+			s := newSACN(1, 100, "WeatherMachine2")
+			s.SetChannel(1, 63)
+			s.SetChannel(4, 200)
+			s.SetChannel(5, 10)
+			s.SetChannel(6, 10)
+			s.SetChannel(7, 50)
+			s.SetChannel(8, 155)
+
+			Ω(s.packet()).Should(Equal(ref))
+		})
+
+		It("should reject channels outside the universe", func() {
+			s := newSACN(1, 100, "WeatherMachine2")
+
+			Ω(s.SetChannel(0, 1)).ShouldNot(BeNil())
+			Ω(s.SetChannel(513, 1)).ShouldNot(BeNil())
+			Ω(s.SetChannel(512, 1)).Should(BeNil())
+		})
+
+		It("should use the standard multicast group for the universe", func() {
+			Ω(sacnMulticastAddress(1)).Should(Equal("239.255.0.1:5568"))
+			Ω(sacnMulticastAddress(300)).Should(Equal("239.255.1.44:5568"))
+		})
+	})
+
+	Context("sending", func() {
+		It("should unicast frames with an incrementing sequence number", func() {
+			ref, err := ioutil.ReadFile("testdata/sacn-universe300.bin")
+			Ω(err).Should(BeNil())
+
+			l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			Ω(err).Should(BeNil())
+			defer l.Close()
+
+			s, err := NewSACNConnection(l.LocalAddr().String(), 300, 150, "Venue Desk Feed")
+			Ω(err).Should(BeNil())
+			defer s.Close()
+
+			s.SetChannel(4, 100)
+			s.SetChannel(5, 15)
+			s.SetChannel(6, 15)
+			s.SetChannel(7, 15)
+			s.SetChannel(8, 15)
+			s.SetChannel(512, 255)
+			Ω(s.Render()).Should(BeNil())
+			Ω(s.Render()).Should(BeNil())
+
+			buf := make([]byte, 1024)
+			l.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = l.Read(buf)
+			Ω(err).Should(BeNil())
+			Ω(buf[111]).Should(Equal(byte(0)))
+
+			n, err := l.Read(buf)
+			Ω(err).Should(BeNil())
+			Ω(buf[:n]).Should(Equal(ref))
+		})
+
+		It("should refuse universes outside the E1.31 range", func() {
+			_, err := NewSACNConnection("127.0.0.1", 0, 100, "WeatherMachine2")
+			Ω(err).ShouldNot(BeNil())
+		})
+	})
+})
@@ -0,0 +1,319 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxBackups is the number of timestamped backups of the configuration file to keep.
+const maxBackups = 5
+
+// jsonField is the location of a top level field within a JSON configuration file.
+type jsonField struct {
+	key   string // The name of the field as written in the file.
+	start int64  // The offset of the first byte of the value.
+	end   int64  // The offset just past the last byte of the value.
+}
+
+// jsonLayout is the layout of the top level object in a JSON configuration file.
+type jsonLayout struct {
+	fields []jsonField // The fields in the order they appear in the file.
+	indent string      // The whitespace in front of each field.
+	sep    string      // The text between each name and its value.
+	close  int64       // The offset of the closing brace.
+}
+
+// readLayout finds where each top level field of the JSON object in b is, so that values can be
+// replaced without disturbing the rest of the file.
+func readLayout(b []byte) (l jsonLayout, err error) {
+	l = jsonLayout{indent: "\t", sep: ":"}
+	d := json.NewDecoder(bytes.NewReader(b))
+
+	t, err := d.Token()
+	if err != nil {
+		return l, err
+	}
+	if t != json.Delim('{') {
+		return l, fmt.Errorf("expected a JSON object")
+	}
+
+	for d.More() {
+		before := d.InputOffset()
+		if t, err = d.Token(); err != nil {
+			return l, err
+		}
+		key := t.(string)
+		after := d.InputOffset()
+
+		var v json.RawMessage
+		if err = d.Decode(&v); err != nil {
+			return l, err
+		}
+		end := d.InputOffset()
+		start := end - int64(len(v))
+
+		// Copy the look of the first field for any fields that get added.
+		if len(l.fields) == 0 {
+			lead := strings.TrimLeft(string(b[before:after]), ",")
+			lead = lead[:strings.LastIndex(lead, "\"")]
+			lead = lead[:strings.LastIndex(lead, "\"")]
+			if i := strings.LastIndex(lead, "\n"); i >= 0 {
+				l.indent = lead[i+1:]
+			}
+			l.sep = string(b[after:start])
+		}
+
+		l.fields = append(l.fields, jsonField{key, start, end})
+	}
+
+	if _, err = d.Token(); err != nil {
+		return l, err
+	}
+	l.close = d.InputOffset() - 1
+
+	return l, nil
+}
+
+// changedFields returns the names of the top level fields in c that differ from the configuration
+// held in the JSON b.
+func changedFields(b []byte, c Configuration) []string {
+	saved := defaultConfiguration()
+	json.Unmarshal(b, &saved) // Anything that fails to parse counts as changed.
+
+	s := reflect.ValueOf(saved)
+	v := reflect.ValueOf(c)
+	changed := []string{}
+	for i := 0; i < v.NumField(); i++ {
+		if !reflect.DeepEqual(s.Field(i).Interface(), v.Field(i).Interface()) {
+			changed = append(changed, v.Type().Field(i).Name)
+		}
+	}
+
+	return changed
+}
+
+// updateJSON returns the JSON configuration b with the values of the changed fields taken from c. Fields
+// already in b are updated where they are, new fields are added to the end, and everything else in b,
+// including its formatting and any fields it does not know about, is left as it is.
+func updateJSON(b []byte, c Configuration, changed []string) ([]byte, error) {
+	if len(bytes.TrimSpace(b)) == 0 {
+		b = []byte("{\n}\n")
+	}
+
+	l, err := readLayout(b)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nested values are indented to match the file, unless the file is all on one line.
+	multiline := bytes.Contains(b, []byte("\n"))
+	v := reflect.ValueOf(c)
+
+	values := map[int][]byte{}
+	added := []byte{}
+	for _, name := range changed {
+		var val []byte
+		if multiline {
+			val, err = json.MarshalIndent(v.FieldByName(name).Interface(), l.indent, l.indent)
+		} else {
+			val, err = json.Marshal(v.FieldByName(name).Interface())
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		found := false
+		for i, f := range l.fields {
+			if strings.EqualFold(f.key, name) {
+				values[i] = val
+				found = true
+			}
+		}
+
+		if !found {
+			if multiline {
+				added = append(added, "\n"+l.indent...)
+			}
+			added = append(added, fmt.Sprintf("%q%s%s,", name, l.sep, val)...)
+		}
+	}
+
+	result := []byte{}
+	last := int64(0)
+	for i, f := range l.fields {
+		if val, ok := values[i]; ok {
+			result = append(result, b[last:f.start]...)
+			result = append(result, val...)
+			last = f.end
+		}
+	}
+
+	// New fields go after the last field in the file.
+	if len(added) > 0 {
+		added = added[:len(added)-1]
+		tail := l.close
+		if len(l.fields) > 0 {
+			tail = l.fields[len(l.fields)-1].end
+			added = append([]byte{','}, added...)
+		} else if multiline {
+			added = append(added, '\n')
+		}
+
+		result = append(result, b[last:tail]...)
+		result = append(result, added...)
+		last = tail
+	}
+
+	return append(result, b[last:]...), nil
+}
+
+// backupConfiguration copies configFile to a timestamped backup alongside it, keeping only the most
+// recent maxBackups. Timestamps are to the nanosecond, and never reuse the name of an earlier backup,
+// so that saves in quick succession each keep their own backup.
+func backupConfiguration(configFile string, b []byte, mode os.FileMode) error {
+	for t := time.Now(); ; t = t.Add(time.Nanosecond) {
+		backup := fmt.Sprintf("%s.%s.bak", configFile, t.Format("20060102-150405.000000000"))
+		f, err := os.OpenFile(backup, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		_, err = f.Write(b)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	// The timestamps sort in the order the backups were made.
+	backups, err := filepath.Glob(configFile + ".*.bak")
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups)
+	for len(backups) > maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// writeAtomic writes b to file with the permissions mode. The new contents are written alongside file
+// before replacing it, so that file is never left half written.
+func writeAtomic(file string, b []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Nothing left to remove once it has been renamed.
+
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+
+	return err
+}
+
+// saveConfiguration writes the fields of c that differ from what is already in configFile, leaving the
+// rest of the file as it is. JSON and YAML files are updated in place. TOML files are written out again
+// in full, losing their comments. The previous file is kept as a timestamped backup, and the file is
+// never left half written.
+func saveConfiguration(configFile string, c Configuration) error {
+	mode := os.FileMode(0644)
+	b, err := ioutil.ReadFile(configFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("ERROR: Unable to read configuration file: %v", err)
+		return err
+	}
+	if info, statErr := os.Stat(configFile); statErr == nil {
+		mode = info.Mode()
+	}
+
+	j, err := toJSON(configFile, b)
+	if err != nil {
+		log.Printf("ERROR: Unable to read configuration file: %v", err)
+		return err
+	}
+
+	j, _ = migrate(j)
+	changed := changedFields(j, c)
+	if len(changed) == 0 {
+		return nil
+	}
+
+	var updated []byte
+	switch configFormat(configFile) {
+	case "json":
+		updated, err = updateJSON(b, c, changed)
+	case "yaml":
+		updated, err = updateYAML(b, c, changed)
+	case "toml":
+		updated, err = updateTOML(b, c, changed)
+		if err == nil && len(b) > 0 {
+			log.Printf("WARNING: Rewriting the TOML file '%s' drops its comments, they remain in its backup", configFile)
+		}
+	}
+	if err != nil {
+		log.Printf("ERROR: Unable to update configuration file: %v", err)
+		return err
+	}
+
+	if len(b) > 0 {
+		if err = backupConfiguration(configFile, b, mode); err != nil {
+			log.Printf("ERROR: Unable to back up configuration file: %v", err)
+			return err
+		}
+	}
+
+	if err = writeAtomic(configFile, updated, mode); err != nil {
+		log.Printf("ERROR: Unable to save configuration file: %v", err)
+		return err
+	}
+
+	log.Printf("INFO: Saved configuration file, updating %s", strings.Join(changed, ", "))
+	return nil
+}
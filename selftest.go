@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// testStep is a single timed step of the self test, switching one output on and then off again.
+type testStep struct {
+	name string                         // What is being tested.
+	hold time.Duration                  // How long to leave the output on.
+	on   func() error                   // Switches the output on.
+	off  func(held time.Duration) error // Switches the output off, after it was held on for held. 0 if it never came on.
+}
+
+// report prints the outcome of a self test step to the technician on w, and the log.
+func report(w io.Writer, name string, err error) bool {
+	if err != nil {
+		fmt.Fprintf(w, "FAIL %s: %v\n", name, err)
+		log.Printf("ERROR: Self test %s failed: %v", name, err)
+		return false
+	}
+
+	fmt.Fprintf(w, "PASS %s\n", name)
+	log.Printf("INFO: Self test %s passed", name)
+	return true
+}
+
+// dmxWrite sets a DMX channel and renders it straight away, so that any failure can be reported.
+func dmxWrite(out DMXOutput, channel int, val byte) error {
+	if err := out.SetChannel(channel, val); err != nil {
+		return err
+	}
+
+	return out.Render()
+}
+
+// testSteps returns the steps of the self test; each light channel, a short puff of smoke, the fan
+// and the pump. The time the pump is held on is recorded with the water tracker.
+func testSteps(c Configuration, out DMXOutput, relayCtrl *RelayControl, water *WaterTracker) []testStep {
+	steps := []testStep{}
+	for i, name := range []string{"red", "green", "blue", "amber", "dimmer"} {
+		ch := 4 + i
+		steps = append(steps, testStep{
+			fmt.Sprintf("light %s (channel %d)", name, ch), time.Second,
+			func() error { return dmxWrite(out, ch, 255) },
+			func(time.Duration) error { return dmxWrite(out, ch, 0) },
+		})
+	}
+
+	steps = append(steps,
+		testStep{"smoke (channel 1)", time.Millisecond * 500,
+			func() error { return dmxWrite(out, 1, byte(c.SmokeVolume)) },
+			func(time.Duration) error { return dmxWrite(out, 1, 0) },
+		},
+		testStep{fmt.Sprintf("fan (relay %d)", c.I2CPinFan), time.Second * 2,
+			func() error { return relayCtrl.enable(c.I2CPinFan) },
+			func(time.Duration) error { return relayCtrl.disable(c.I2CPinFan) },
+		},
+		testStep{fmt.Sprintf("pump (relay %d)", c.I2CPinPump), time.Second,
+			func() error {
+				if !water.canPump() {
+					return fmt.Errorf("reservoir needs a refill")
+				}
+				return relayCtrl.enable(c.I2CPinPump)
+			},
+			func(held time.Duration) error {
+				if held > 0 {
+					water.pumped(held)
+				}
+				return relayCtrl.disable(c.I2CPinPump)
+			},
+		},
+	)
+
+	return steps
+}
+
+// runSteps runs each step of the self test in turn, reporting the outcome of each on w. Every output
+// is switched off again, even if switching it on failed. It returns true if every step passed.
+func runSteps(w io.Writer, steps []testStep) bool {
+	passed := true
+	for _, s := range steps {
+		fmt.Fprintf(w, "     %s...\n", s.name)
+		held := time.Duration(0)
+		err := s.on()
+		if err == nil {
+			time.Sleep(s.hold)
+			held = s.hold
+		}
+
+		// Always switch the output off again, even if switching it on failed.
+		if offErr := s.off(held); err == nil {
+			err = offErr
+		}
+		passed = report(w, s.name, err) && passed
+	}
+
+	return passed
+}
+
+// selfTest walks through each output of the installation in turn; each light channel, a short puff
+// of smoke, the fan and the pump, reporting whether each write succeeded. It returns true if every
+// step passed.
+func selfTest(c Configuration, relayCtrl *RelayControl, water *WaterTracker) bool {
+	fmt.Println("WeatherMachine2 self test")
+	log.Printf("INFO: Starting self test")
+
+	out, err := connectDMX(c)
+	if !report(os.Stdout, "DMX output", err) {
+		return false
+	}
+	defer out.Close()
+
+	passed := runSteps(os.Stdout, testSteps(c, out, relayCtrl, water))
+	if passed {
+		fmt.Println("Self test passed")
+	} else {
+		fmt.Println("Self test FAILED")
+	}
+
+	return passed
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+// failingBus is an I2C bus where every write fails, like an expander that has come loose.
+type failingBus struct {
+	nullBus
+}
+
+func (b failingBus) WriteByteToReg(addr, reg, value byte) error {
+	return errors.New("no acknowledgement")
+}
+
+// failingOutput is a DMX output that takes channel values but fails to render them.
+type failingOutput struct {
+	channels [512]byte // The channel values most recently set.
+}
+
+func (o *failingOutput) SetChannel(channel int, val byte) error {
+	o.channels[channel-1] = val
+	return nil
+}
+func (o *failingOutput) Render() error { return errors.New("interface not responding") }
+func (o *failingOutput) Close() error  { return nil }
+
+var _ = Describe("Self test", func() {
+	var c Configuration
+	var water *WaterTracker
+
+	BeforeEach(func() {
+		c = defaultConfiguration()
+		c.SmokeVolume = 80
+		water = NewWaterTracker(Reservoir{Capacity: 1000, FlowRate: 10}, nil)
+	})
+
+	// quick returns the steps of the self test, without holding any output on for long.
+	quick := func(steps []testStep) []testStep {
+		for i := range steps {
+			steps[i].hold = 10 * time.Millisecond
+		}
+		return steps
+	}
+
+	It("should pass every step and leave every output off", func() {
+		out := &recordingOutput{}
+		relayCtrl := NewRelayCtrl(nullBus{})
+		var w bytes.Buffer
+
+		Ω(runSteps(&w, quick(testSteps(c, out, relayCtrl, water)))).Should(BeTrue())
+
+		Ω(w.String()).Should(ContainSubstring("PASS light red (channel 4)"))
+		Ω(w.String()).Should(ContainSubstring("PASS smoke (channel 1)"))
+		Ω(w.String()).Should(ContainSubstring("PASS pump (relay"))
+		Ω(w.String()).ShouldNot(ContainSubstring("FAIL"))
+		Ω(out.rendered).Should(Equal([512]byte{}))
+		Ω(out.renders).Should(Equal(12))
+		Ω(relayCtrl.on(c.I2CPinFan)).Should(BeFalse())
+		Ω(relayCtrl.on(c.I2CPinPump)).Should(BeFalse())
+	})
+
+	It("should record the water used by the pump step", func() {
+		var w bytes.Buffer
+
+		runSteps(&w, quick(testSteps(c, &recordingOutput{}, NewRelayCtrl(nullBus{}), water)))
+
+		Ω(water.Status().Used).Should(BeNumerically("~", 0.1, 1e-6))
+	})
+
+	It("should report a failing DMX output and still switch each channel off", func() {
+		out := &failingOutput{}
+		var w bytes.Buffer
+
+		Ω(runSteps(&w, quick(testSteps(c, out, NewRelayCtrl(nullBus{}), water)))).Should(BeFalse())
+
+		Ω(w.String()).Should(ContainSubstring("FAIL light red (channel 4): interface not responding"))
+		Ω(w.String()).Should(ContainSubstring("FAIL smoke (channel 1): interface not responding"))
+		Ω(w.String()).Should(ContainSubstring("PASS fan (relay"))
+		Ω(out.channels).Should(Equal([512]byte{}))
+	})
+
+	It("should report failing relays, still switch them off and not count water", func() {
+		relayCtrl := NewRelayCtrl(failingBus{})
+		var w bytes.Buffer
+
+		Ω(runSteps(&w, quick(testSteps(c, &recordingOutput{}, relayCtrl, water)))).Should(BeFalse())
+
+		Ω(w.String()).Should(ContainSubstring("FAIL fan (relay"))
+		Ω(w.String()).Should(ContainSubstring("FAIL pump (relay"))
+		Ω(relayCtrl.on(c.I2CPinFan)).Should(BeFalse())
+		Ω(relayCtrl.on(c.I2CPinPump)).Should(BeFalse())
+		Ω(water.Status().Used).Should(BeNumerically("==", 0))
+	})
+
+	It("should refuse to run the pump dry", func() {
+		water.pumped(100 * time.Second)
+		relayCtrl := NewRelayCtrl(nullBus{})
+		var w bytes.Buffer
+
+		runSteps(&w, quick(testSteps(c, &recordingOutput{}, relayCtrl, water)))
+
+		Ω(w.String()).Should(ContainSubstring("reservoir needs a refill"))
+		Ω(relayCtrl.on(c.I2CPinPump)).Should(BeFalse())
+	})
+})
@@ -0,0 +1,42 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"log"
+)
+
+// shutdown winds down whatever the installation was doing and drives every output off, ready for
+// the program to exit.
+func shutdown(state *WeatherMachine, current stateFn, refresh chan bool) {
+	log.Printf("INFO: Shutting down WeatherMachine2")
+
+	if !state.halted {
+		windDown(state, current)
+	}
+
+	refresh <- true
+	if err := state.dmx.blackout(); err != nil {
+		log.Printf("ERROR: Unable to switch off the lights and smoke: %v", err)
+	}
+	if err := state.relayCtrl.halt(true); err != nil {
+		log.Printf("ERROR: Unable to switch off the fan and pump: %v", err)
+	}
+}
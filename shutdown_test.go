@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Shutdown", func() {
+	var state WeatherMachine
+	var out *recordingOutput
+	var refresh chan bool
+
+	BeforeEach(func() {
+		c := defaultConfiguration()
+		c.Reservoir.StateFile = ""
+		c.FanDuration = 10
+		out = &recordingOutput{}
+		state = WeatherMachine{attract: make(chan bool), lightning: make(chan bool, 1), cueHR: make(chan int, 1),
+			pulseHR: make(chan int, 1), config: c, live: NewLiveConfig(c), dmx: NewFrameBuffer(out, 200),
+			smoke: NewSmokeGovernor(c.SmokeBudget), relayCtrl: NewRelayCtrl(nullBus{}),
+			water: NewWaterTracker(c.Reservoir, nil), clearAt: time.Now()}
+
+		refresh = make(chan bool)
+		go state.dmx.refresh(refresh)
+	})
+
+	// allOff returns true if the last frame rendered has every channel at zero.
+	allOff := func() bool {
+		out.mu.Lock()
+		defer out.mu.Unlock()
+
+		return out.rendered == [512]byte{}
+	}
+
+	It("should stop attract mode and black out the output when idle", func() {
+		go enableAttract(state.live, state.attract, state.dmx)
+		state.dmx.SetChannel(1, 80)
+		Eventually(func() byte { return out.channel(1) }).Should(Equal(byte(80)))
+
+		shutdown(&state, idle, refresh)
+
+		Ω(attracting(state.attract)).Should(BeFalse())
+		Ω(allOff()).Should(BeTrue())
+		Ω(relaysHalted(state.relayCtrl)).Should(BeTrue())
+	})
+
+	It("should end a running session and switch off the fan and pump", func() {
+		go enableAttract(state.live, state.attract, state.dmx)
+		update := idle(&state, HRMsg{0, true})
+		update = update(&state, HRMsg{70, true})
+		state.relayCtrl.enable(state.config.I2CPinFan)
+		state.relayCtrl.enable(state.config.I2CPinPump)
+
+		shutdown(&state, update, refresh)
+
+		Ω(state.stop).Should(BeClosed())
+		Ω(state.inSession).Should(BeFalse())
+		Ω(attracting(state.attract)).Should(BeFalse())
+		Ω(allOff()).Should(BeTrue())
+		Ω(state.relayCtrl.on(state.config.I2CPinFan)).Should(BeFalse())
+		Ω(state.relayCtrl.on(state.config.I2CPinPump)).Should(BeFalse())
+	})
+
+	It("should not wind down again after an emergency stop", func() {
+		go enableAttract(state.live, state.attract, state.dmx)
+		emergencyStop(&state, idle)
+		state.dmx.SetChannel(4, 200)
+
+		shutdown(&state, stopped, refresh)
+
+		Ω(allOff()).Should(BeTrue())
+		Ω(state.dmx.Channel(4)).Should(Equal(byte(0)))
+		Ω(relaysHalted(state.relayCtrl)).Should(BeTrue())
+	})
+
+	It("should still switch off the relays when the output has gone", func() {
+		state.closed = true
+		state.relayCtrl.enable(state.config.I2CPinFan)
+		out.Close()
+
+		shutdown(&state, closed, refresh)
+
+		Ω(state.relayCtrl.on(state.config.I2CPinFan)).Should(BeFalse())
+		Ω(relaysHalted(state.relayCtrl)).Should(BeTrue())
+	})
+})
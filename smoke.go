@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type SmokeBudget struct {
+	Window     int // The number of milliseconds in the rolling window that MaxOn applies to.
+	MaxOn      int // The most milliseconds of smoke within any window. 0 for no limit.
+	MinGap     int // The fewest milliseconds between the end of one puff and the start of the next.
+	SessionCap int // The most milliseconds of smoke in a single session. 0 for no limit.
+}
+
+// puff is a single puff of smoke.
+type puff struct {
+	start    time.Time
+	duration time.Duration
+}
+
+// SmokeGovernor keeps the smoke machine within its budget. Every puff on DMX channel 1 asks the
+// governor first, so no combination of cues can overfill the chamber or overheat the fogger.
+type SmokeGovernor struct {
+	mu      sync.Mutex    // Guards everything below.
+	budget  SmokeBudget   // The limits on smoke output.
+	puffs   []puff        // The puffs within the current window, oldest first.
+	session time.Duration // The amount of smoke in the current session.
+}
+
+// NewSmokeGovernor creates a governor that enforces the budget b.
+func NewSmokeGovernor(b SmokeBudget) *SmokeGovernor {
+	return &SmokeGovernor{budget: b}
+}
+
+// setBudget changes the budget the governor enforces. Smoke already made still counts against it.
+func (g *SmokeGovernor) setBudget(b SmokeBudget) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.budget = b
+}
+
+// newSession resets the per-session smoke cap.
+func (g *SmokeGovernor) newSession() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.session = 0
+}
+
+// request asks for a puff of smoke lasting d starting at the time now. It returns how long the puff
+// may last, which is trimmed to whatever budget remains, and is zero if the puff must be suppressed.
+// The reason for any trimming or suppression is returned for logging.
+func (g *SmokeGovernor) request(d time.Duration, now time.Time) (time.Duration, string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	b := g.budget
+	window := time.Millisecond * time.Duration(b.Window)
+
+	// Forget puffs that ended before the window.
+	i := 0
+	for i < len(g.puffs) && now.Sub(g.puffs[i].start.Add(g.puffs[i].duration)) > window {
+		i++
+	}
+	g.puffs = g.puffs[i:]
+
+	if len(g.puffs) > 0 {
+		last := g.puffs[len(g.puffs)-1]
+		if gap := now.Sub(last.start.Add(last.duration)); gap < time.Millisecond*time.Duration(b.MinGap) {
+			return 0, "minimum gap between puffs"
+		}
+	}
+
+	reason := ""
+	if b.MaxOn > 0 {
+		used := time.Duration(0)
+		for _, p := range g.puffs {
+			used += p.duration
+		}
+
+		if left := time.Millisecond*time.Duration(b.MaxOn) - used; left < d {
+			d, reason = left, "maximum smoke per window"
+		}
+	}
+
+	if b.SessionCap > 0 {
+		if left := time.Millisecond*time.Duration(b.SessionCap) - g.session; left < d {
+			d, reason = left, "maximum smoke per session"
+		}
+	}
+
+	if d <= 0 {
+		return 0, reason
+	}
+
+	g.puffs = append(g.puffs, puff{now, d})
+	g.session += d
+	return d, reason
+}
+
+// puffSmoke enables the smoke machine via the supplied DMX frame buffer 'dmx' at the supplied
+// volume for duration milliseconds, or as much of it as the smoke governor 'g' allows.
+func puffSmoke(volume int, duration int, g *SmokeGovernor, dmx *FrameBuffer) {
+	want := time.Millisecond * time.Duration(duration)
+	d, reason := g.request(want, time.Now())
+	if d == 0 {
+		log.Printf("INFO: Suppressed smoke puff, %s", reason)
+		return
+	} else if d < want {
+		log.Printf("INFO: Trimmed smoke puff to %dms, %s", d/time.Millisecond, reason)
+	}
+
+	dmx.SetChannel(1, byte(volume))
+	events.publish("smoke", map[string]interface{}{"On": true, "Volume": volume})
+
+	time.Sleep(d)
+
+	dmx.SetChannel(1, 0)
+	events.publish("smoke", map[string]interface{}{"On": false})
+}
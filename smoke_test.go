@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Smoke budget", func() {
+	start := time.Now()
+
+	It("should suppress puffs too close together", func() {
+		g := NewSmokeGovernor(SmokeBudget{Window: 60000, MinGap: 1000})
+
+		d, _ := g.request(500*time.Millisecond, start)
+		Ω(d).Should(Equal(500 * time.Millisecond))
+
+		d, reason := g.request(500*time.Millisecond, start.Add(time.Second))
+		Ω(d).Should(Equal(time.Duration(0)))
+		Ω(reason).Should(Equal("minimum gap between puffs"))
+
+		d, _ = g.request(500*time.Millisecond, start.Add(1500*time.Millisecond))
+		Ω(d).Should(Equal(500 * time.Millisecond))
+	})
+
+	It("should trim puffs to the smoke left in the window", func() {
+		g := NewSmokeGovernor(SmokeBudget{Window: 10000, MaxOn: 1200})
+
+		g.request(500*time.Millisecond, start)
+		g.request(500*time.Millisecond, start.Add(time.Second))
+		d, reason := g.request(500*time.Millisecond, start.Add(2*time.Second))
+		Ω(d).Should(Equal(200 * time.Millisecond))
+		Ω(reason).Should(Equal("maximum smoke per window"))
+
+		d, _ = g.request(500*time.Millisecond, start.Add(3*time.Second))
+		Ω(d).Should(Equal(time.Duration(0)))
+
+		// The first puffs have left the window.
+		d, _ = g.request(500*time.Millisecond, start.Add(12*time.Second))
+		Ω(d).Should(Equal(500 * time.Millisecond))
+	})
+
+	It("should cap the smoke in a session", func() {
+		g := NewSmokeGovernor(SmokeBudget{Window: 1000, SessionCap: 800})
+
+		g.request(500*time.Millisecond, start)
+		d, _ := g.request(500*time.Millisecond, start.Add(10*time.Second))
+		Ω(d).Should(Equal(300 * time.Millisecond))
+
+		g.newSession()
+		d, _ = g.request(500*time.Millisecond, start.Add(20*time.Second))
+		Ω(d).Should(Equal(500 * time.Millisecond))
+	})
+})
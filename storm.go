@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+type CurvePoint struct {
+	BPM   float32 // The heart rate of this point on the curve.
+	Value float32 // The value of the curve at this heart rate.
+}
+
+type StormCurves struct {
+	SmokeVolume   []CurvePoint // The smoke volume (0-255) for each heart rate. Empty to use the cue volume.
+	SmokeInterval []CurvePoint // The number of milliseconds between smoke puffs for each heart rate. Empty to use the cue timing.
+	PumpDuty      []CurvePoint // The fraction (0-1) of each pump interval to run the pump for each heart rate. Empty to use the cue duration.
+	TrendWindow   int          // The number of milliseconds of heart rate readings to measure the trend over.
+	TrendGain     float32      // The number of BPM to add to the heart rate for every BPM per minute it is rising.
+}
+
+// curveAt linearly interpolates the value of the curve at the heart rate bpm. Heart rates outside the
+// curve take the value of the nearest point.
+func curveAt(curve []CurvePoint, bpm float32) float32 {
+	p := make([]CurvePoint, len(curve))
+	copy(p, curve)
+	sort.Slice(p, func(i, j int) bool { return p[i].BPM < p[j].BPM })
+
+	i := sort.Search(len(p), func(i int) bool { return p[i].BPM >= bpm })
+	switch {
+	case i == 0:
+		return p[0].Value
+	case i == len(p):
+		return p[len(p)-1].Value
+	}
+
+	a, b := p[i-1], p[i]
+	return a.Value + (b.Value-a.Value)*(bpm-a.BPM)/(b.BPM-a.BPM)
+}
+
+// heartSample is a heart rate reading and when it was taken.
+type heartSample struct {
+	bpm int
+	at  time.Time
+}
+
+// heartTrend tracks recent heart rate readings to work out whether the heart is racing or calming.
+type heartTrend struct {
+	window  time.Duration // How far back readings are kept.
+	samples []heartSample // The readings within the window, oldest first.
+}
+
+// add records the heart rate reading bpm taken at the time at.
+func (h *heartTrend) add(bpm int, at time.Time) {
+	h.samples = append(h.samples, heartSample{bpm, at})
+
+	i := 0
+	for i < len(h.samples)-1 && at.Sub(h.samples[i].at) > h.window {
+		i++
+	}
+	h.samples = h.samples[i:]
+}
+
+// slope returns how fast the heart rate is changing in BPM per minute over the window.
+func (h *heartTrend) slope() float32 {
+	if len(h.samples) < 2 {
+		return 0.0
+	}
+
+	first, last := h.samples[0], h.samples[len(h.samples)-1]
+	dt := last.at.Sub(first.at).Minutes()
+	if dt <= 0 {
+		return 0.0
+	}
+
+	return float32(float64(last.bpm-first.bpm) / dt)
+}
+
+// stormBPM returns the heart rate that drives the intensity of the storm, the latest reading pushed
+// up when the heart is racing and down when it is calming.
+func stormBPM(s StormCurves, h *heartTrend) float32 {
+	if len(h.samples) == 0 {
+		return 0.0
+	}
+
+	return float32(h.samples[len(h.samples)-1].bpm) + s.TrendGain*h.slope()
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Storm", func() {
+	volume := []CurvePoint{{120, 200}, {60, 40}}
+
+	It("should interpolate curves between points", func() {
+		Ω(curveAt(volume, 90)).Should(BeNumerically("~", 120, 0.001))
+		Ω(curveAt(volume, 60)).Should(BeNumerically("~", 40, 0.001))
+	})
+
+	It("should clamp curves outside their points", func() {
+		Ω(curveAt(volume, 40)).Should(BeNumerically("~", 40, 0.001))
+		Ω(curveAt(volume, 180)).Should(BeNumerically("~", 200, 0.001))
+	})
+
+	It("should push the storm heart rate up when the heart is racing", func() {
+		start := time.Now()
+		h := &heartTrend{window: time.Minute}
+		h.add(60, start)
+		h.add(70, start.Add(30*time.Second))
+
+		Ω(h.slope()).Should(BeNumerically("~", 20, 0.001))
+		Ω(stormBPM(StormCurves{TrendGain: 0.5}, h)).Should(BeNumerically("~", 80, 0.001))
+	})
+
+	It("should forget readings outside the trend window", func() {
+		start := time.Now()
+		h := &heartTrend{window: time.Minute}
+		h.add(100, start)
+		h.add(60, start.Add(2*time.Minute))
+
+		Ω(h.samples).Should(HaveLen(1))
+		Ω(h.slope()).Should(BeNumerically("~", 0, 0.001))
+	})
+})
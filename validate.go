@@ -0,0 +1,318 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ConfigErrors is every problem found with a configuration, each prefixed by the path to the field.
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// add records a problem with the field at path.
+func (e *ConfigErrors) add(path string, format string, args ...interface{}) {
+	*e = append(*e, path+": "+fmt.Sprintf(format, args...))
+}
+
+// between checks that the field at path lies within min and max.
+func (e *ConfigErrors) between(path string, v float64, min float64, max float64) {
+	if v < min || v > max {
+		e.add(path, "%v is outside %v-%v", v, min, max)
+	}
+}
+
+// atLeast checks that the field at path is no smaller than min.
+func (e *ConfigErrors) atLeast(path string, v float64, min float64) {
+	if v < min {
+		e.add(path, "%v must be at least %v", v, min)
+	}
+}
+
+// oneOf checks that the field at path is one of the allowed values.
+func (e *ConfigErrors) oneOf(path string, v string, allowed ...string) {
+	for _, a := range allowed {
+		if v == a {
+			return
+		}
+	}
+	e.add(path, "'%s' must be one of '%s'", v, strings.Join(allowed, "', '"))
+}
+
+// validateColour checks each channel of the light colour at path.
+func (e *ConfigErrors) validateColour(path string, l LightColour) {
+	e.between(path+".Red", float64(l.Red), 0, 255)
+	e.between(path+".Green", float64(l.Green), 0, 255)
+	e.between(path+".Blue", float64(l.Blue), 0, 255)
+	e.between(path+".Amber", float64(l.Amber), 0, 255)
+	e.between(path+".Dimmer", float64(l.Dimmer), 0, 255)
+}
+
+// validateEnvelope checks the light envelope at path.
+func (e *ConfigErrors) validateEnvelope(path string, env Envelope) {
+	e.atLeast(path+".Attack", float64(env.Attack), 0)
+	e.atLeast(path+".Decay", float64(env.Decay), 0)
+	e.oneOf(path+".Curve", env.Curve, "", "linear", "exponential", "gamma")
+}
+
+// validateInput checks the wiring of the input at path.
+func (e *ConfigErrors) validateInput(path string, p InputPin) {
+	e.oneOf(path+".Source", p.Source, "", "gpio", "expander")
+	if p.Source == "expander" {
+		e.between(path+".Pin", float64(p.Pin), 0, 7)
+	} else {
+		e.atLeast(path+".Pin", float64(p.Pin), 0)
+	}
+}
+
+// validateCurve checks the points of the storm curve at path, whose values lie within min and max.
+func (e *ConfigErrors) validateCurve(path string, curve []CurvePoint, min float64, max float64) {
+	for i, p := range curve {
+		e.atLeast(fmt.Sprintf("%s[%d].BPM", path, i), float64(p.BPM), 1)
+		e.between(fmt.Sprintf("%s[%d].Value", path, i), float64(p.Value), min, max)
+	}
+}
+
+// validateCues checks each cue in the timeline.
+func (e *ConfigErrors) validateCues(path string, cues []Cue) {
+	for i, c := range cues {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		e.oneOf(p+".Action", c.Action, "light", "smoke", "pump", "fan")
+		e.oneOf(p+".From", c.From, "", "contact", "heartrate")
+		e.atLeast(p+".At", float64(c.At), 0)
+		e.atLeast(p+".AtBeats", float64(c.AtBeats), 0)
+		e.atLeast(p+".Every", float64(c.Every), 0)
+		e.atLeast(p+".EveryBeats", float64(c.EveryBeats), 0)
+		e.atLeast(p+".Duration", float64(c.Duration), 0)
+		e.between(p+".Volume", float64(c.Volume), 0, 255)
+		e.validateColour(p+".Colour", c.Colour)
+	}
+}
+
+// validateConfiguration checks that every field of the configuration is usable by the installation,
+// returning ConfigErrors describing all the problems found, or nil if there are none.
+func validateConfiguration(c Configuration) error {
+	e := ConfigErrors{}
+
+	e.atLeast("Version", float64(c.Version), 0)
+	if c.Version > configVersion {
+		e.add("Version", "%d is newer than the latest version this installation understands, %d", c.Version, configVersion)
+	}
+	e.between("SmokeVolume", float64(c.SmokeVolume), 0, 255)
+	e.atLeast("DeltaTSmoke", float64(c.DeltaTSmoke), 0)
+	e.atLeast("DeltaTFan", float64(c.DeltaTFan), 0)
+	e.atLeast("DeltaTPump", float64(c.DeltaTPump), 0)
+	e.between("I2CPinFan", float64(c.I2CPinFan), 0, 7)
+	e.between("I2CPinPump", float64(c.I2CPinPump), 0, 7)
+	e.between("I2CPinLight", float64(c.I2CPinLight), 0, 7)
+	e.atLeast("SmokeDuration", float64(c.SmokeDuration), 0)
+	e.atLeast("FanDuration", float64(c.FanDuration), 0)
+	if c.BeatRate <= 0 {
+		e.add("BeatRate", "%v must be greater than 0", c.BeatRate)
+	}
+	e.validateColour("S1Beat", c.S1Beat)
+	e.atLeast("S1Duration", float64(c.S1Duration), 0)
+	e.validateColour("S2Beat", c.S2Beat)
+	e.atLeast("S2Duration", float64(c.S2Duration), 0)
+	e.atLeast("S1Pause", float64(c.S1Pause), 0)
+	e.atLeast("SmokeInterval", float64(c.SmokeInterval), 0)
+	e.atLeast("PumpDuration", float64(c.PumpDuration), 0)
+	e.atLeast("PumpInterval", float64(c.PumpInterval), 0)
+
+	e.oneOf("OutputMode", c.OutputMode, "usb", "sacn")
+	e.between("SACNUniverse", float64(c.SACNUniverse), 1, 63999)
+	e.between("SACNPriority", float64(c.SACNPriority), 0, 200)
+	if len(c.SACNSource) > 63 {
+		e.add("SACNSource", "must be no longer than 63 bytes")
+	}
+	e.between("FrameRate", float64(c.FrameRate), 1, 100)
+
+	e.validateEnvelope("S1Envelope", c.S1Envelope)
+	e.validateEnvelope("S2Envelope", c.S2Envelope)
+
+	for i, s := range c.ColourMap {
+		e.atLeast(fmt.Sprintf("ColourMap[%d].BPM", i), float64(s.BPM), 1)
+		e.validateColour(fmt.Sprintf("ColourMap[%d].Colour", i), s.Colour)
+	}
+
+	e.validateColour("AttractColour", c.AttractColour)
+	e.validateColour("AttractFlash", c.AttractFlash)
+	e.atLeast("AttractPeriod", float64(c.AttractPeriod), 0)
+	e.atLeast("AttractFlicker", float64(c.AttractFlicker), 0)
+
+	e.atLeast("Lightning.Density", float64(c.Lightning.Density), 0)
+	e.between("Lightning.Intensity", float64(c.Lightning.Intensity), 0, 255)
+	e.between("Lightning.Temperature", float64(c.Lightning.Temperature), 1000, 40000)
+	e.atLeast("Lightning.MinFlashes", float64(c.Lightning.MinFlashes), 1)
+	e.atLeast("Lightning.MaxFlashes", float64(c.Lightning.MaxFlashes), float64(c.Lightning.MinFlashes))
+	e.atLeast("Lightning.SpikeBPM", float64(c.Lightning.SpikeBPM), 0)
+
+	if c.CueFile != "" {
+		cues, err := loadCues(c.CueFile)
+		if err != nil {
+			e.add("CueFile", "unable to load '%s': %v", c.CueFile, err)
+		}
+		e.validateCues("CueFile", cues)
+	}
+
+	e.validateCurve("Storm.SmokeVolume", c.Storm.SmokeVolume, 0, 255)
+	e.validateCurve("Storm.SmokeInterval", c.Storm.SmokeInterval, 1, 3600000)
+	e.validateCurve("Storm.PumpDuty", c.Storm.PumpDuty, 0, 1)
+	e.atLeast("Storm.TrendWindow", float64(c.Storm.TrendWindow), 0)
+
+	for i, p := range c.Phases {
+		path := fmt.Sprintf("Phases[%d]", i)
+		e.atLeast(path+".Start", float64(p.Start), 0)
+		e.atLeast(path+".SmokeScale", float64(p.SmokeScale), 0)
+		e.atLeast(path+".RainScale", float64(p.RainScale), 0)
+		e.atLeast(path+".LightScale", float64(p.LightScale), 0)
+		e.atLeast(path+".PaceScale", float64(p.PaceScale), 0)
+	}
+	e.atLeast("MaxSession", float64(c.MaxSession), 0)
+
+	e.atLeast("SmokeBudget.Window", float64(c.SmokeBudget.Window), 0)
+	e.atLeast("SmokeBudget.MaxOn", float64(c.SmokeBudget.MaxOn), 0)
+	e.atLeast("SmokeBudget.MinGap", float64(c.SmokeBudget.MinGap), 0)
+	e.atLeast("SmokeBudget.SessionCap", float64(c.SmokeBudget.SessionCap), 0)
+	if c.SmokeBudget.MaxOn > 0 && c.SmokeBudget.MaxOn > c.SmokeBudget.Window {
+		e.add("SmokeBudget.MaxOn", "%d is longer than the window of %d", c.SmokeBudget.MaxOn, c.SmokeBudget.Window)
+	}
+
+	e.atLeast("Reservoir.Capacity", float64(c.Reservoir.Capacity), 0)
+	e.atLeast("Reservoir.FlowRate", float64(c.Reservoir.FlowRate), 0)
+	if c.Reservoir.Capacity > 0 && c.Reservoir.FlowRate <= 0 {
+		e.add("Reservoir.FlowRate", "must be greater than 0 to track water use")
+	}
+	e.between("Reservoir.RefillLevel", float64(c.Reservoir.RefillLevel), 0, float64(c.Reservoir.Capacity))
+	e.validateInput("Reservoir.LevelSwitch", c.Reservoir.LevelSwitch)
+	e.validateInput("EStop", c.EStop)
+	e.validateProfiles(c)
+	e.validateHours("Hours", c.Hours)
+
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// validateProfiles checks that every profile would give a valid configuration when run over c, and
+// that the profile and schedule name profiles that exist.
+func (e *ConfigErrors) validateProfiles(c Configuration) {
+	for _, name := range profileNames(c) {
+		path := "Profiles." + name
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(c.Profiles[name], &fields); err != nil {
+			e.add(path, "must be a set of fields")
+			continue
+		}
+		nested := false
+		for key := range fields {
+			for _, f := range []string{"Profiles", "Profile", "ProfileSchedule"} {
+				if strings.EqualFold(key, f) {
+					e.add(path+"."+f, "can not be set within a profile")
+					nested = true
+				}
+			}
+		}
+		if nested {
+			continue
+		}
+
+		p := c
+		p.Profiles, p.Profile, p.ProfileSchedule = nil, "", nil
+		profile, _ := migrate(c.Profiles[name])
+		err := decodeLayer(profile, &p)
+		if err == nil {
+			err = validateConfiguration(p)
+		}
+		if errs, ok := err.(ConfigErrors); ok {
+			for _, pe := range errs {
+				*e = append(*e, path+"."+pe)
+			}
+		} else if err != nil {
+			e.add(path, "%v", err)
+		}
+	}
+
+	if _, ok := c.Profiles[c.Profile]; c.Profile != "" && !ok {
+		e.add("Profile", "unknown profile '%s'", c.Profile)
+	}
+
+	for i, s := range c.ProfileSchedule {
+		path := fmt.Sprintf("ProfileSchedule[%d]", i)
+		if _, err := minuteOfDay(s.At); err != nil {
+			e.add(path+".At", "%v", err)
+		}
+		if _, ok := c.Profiles[s.Profile]; s.Profile != "" && !ok {
+			e.add(path+".Profile", "unknown profile '%s'", s.Profile)
+		}
+	}
+}
+
+// unknownFields returns the path of every key in the JSON object raw that does not map onto a field of
+// the struct type t. Like encoding/json, keys are matched to field names ignoring case.
+func unknownFields(raw json.RawMessage, t reflect.Type, path string) []string {
+	switch t.Kind() {
+	case reflect.Slice:
+		var items []json.RawMessage
+		if json.Unmarshal(raw, &items) != nil {
+			return nil
+		}
+
+		unknown := []string{}
+		for i, item := range items {
+			unknown = append(unknown, unknownFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return unknown
+
+	case reflect.Struct:
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(raw, &fields) != nil {
+			return nil
+		}
+
+		unknown := []string{}
+		for key, value := range fields {
+			p := key
+			if path != "" {
+				p = path + "." + key
+			}
+
+			f, ok := t.FieldByNameFunc(func(name string) bool { return strings.EqualFold(name, key) })
+			if !ok {
+				unknown = append(unknown, p)
+				continue
+			}
+			unknown = append(unknown, unknownFields(value, f.Type, p)...)
+		}
+		sort.Strings(unknown)
+		return unknown
+	}
+
+	return nil
+}
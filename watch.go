@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// reloadDebounce is how long the configuration files must be left alone before they are reloaded,
+// editors often write a file in several steps.
+const reloadDebounce = time.Millisecond * 500
+
+// diffConfiguration returns a description of every field that differs between a and b, in the form
+// "Path: old -> new".
+func diffConfiguration(a Configuration, b Configuration) []string {
+	return diffValues(reflect.ValueOf(a), reflect.ValueOf(b), "")
+}
+
+// diffValues returns a description of every field that differs between a and b, found at path.
+func diffValues(a reflect.Value, b reflect.Value, path string) []string {
+	if a.Kind() == reflect.Struct {
+		diff := []string{}
+		for i := 0; i < a.NumField(); i++ {
+			p := a.Type().Field(i).Name
+			if path != "" {
+				p = path + "." + p
+			}
+			diff = append(diff, diffValues(a.Field(i), b.Field(i), p)...)
+		}
+		return diff
+	}
+
+	if reflect.DeepEqual(a.Interface(), b.Interface()) {
+		return nil
+	}
+
+	was, _ := json.Marshal(a.Interface())
+	now, _ := json.Marshal(b.Interface())
+	return []string{fmt.Sprintf("%s: %s -> %s", path, was, now)}
+}
+
+// configReloader reloads the configuration from its layers, only passing it on when it has
+// actually changed and is valid.
+type configReloader struct {
+	layers  configLayers  // Where the configuration comes from.
+	current Configuration // The last good configuration.
+	content []byte        // The contents of the configuration files when last checked.
+}
+
+// readLayers returns the combined contents of every configuration file.
+func (r *configReloader) readLayers() []byte {
+	site, _ := ioutil.ReadFile(r.layers.site)
+	local, _ := ioutil.ReadFile(r.layers.local)
+
+	return append(append(site, 0), local...)
+}
+
+// check reloads the configuration if the files have changed since they were last checked, sending
+// it on c if it validates and differs from the current configuration. A configuration that fails to
+// load, or a missing site file, never replaces the current one.
+func (r *configReloader) check(c chan Configuration) {
+	content := r.readLayers()
+	if bytes.Equal(content, r.content) {
+		return
+	}
+	r.content = content
+
+	config, err := loadLayers(r.layers)
+	if err != nil {
+		log.Printf("ERROR: Unable to reload '%s', keeping the current configuration: %v", r.layers.site, err)
+		return
+	}
+
+	diff := diffConfiguration(r.current, config)
+	if len(diff) == 0 {
+		return
+	}
+
+	log.Printf("INFO: Reloaded '%s'", r.layers.site)
+	if was, now := activeProfile(r.current, time.Now()), activeProfile(config, time.Now()); was != now {
+		log.Printf("INFO: Switching from the '%s' profile to '%s'", was, now)
+	}
+	for _, d := range diff {
+		log.Printf("INFO:   %s", d)
+	}
+
+	r.current = config
+	c <- config
+}
+
+// updateConfiguration watches the configuration files for changes, sending each new valid configuration
+// on c. current is the configuration the installation started with. The configuration is also reloaded
+// whenever the ProfileSchedule switches profile. If the files can't be watched it falls back to checking
+// them every 30 seconds.
+func updateConfiguration(c chan Configuration, layers configLayers, current Configuration) {
+	r := &configReloader{layers: layers, current: current}
+	r.content = r.readLayers()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		defer watcher.Close()
+
+		// Watch the directories rather than the files, editors often replace a file rather than write to it.
+		for _, dir := range []string{filepath.Dir(layers.site), filepath.Dir(layers.local)} {
+			if err = watcher.Add(dir); err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		log.Printf("ERROR: Unable to watch the configuration files, checking every 30 seconds: %v", err)
+		if watcher != nil {
+			watcher.Close() // Polling never returns, so don't leave the watcher open till then.
+		}
+		for range time.Tick(time.Second * 30) {
+			if now := time.Now(); activeProfile(r.current, now) != activeProfile(r.current, now.Add(-time.Second*30)) {
+				r.content = nil // The schedule has moved on, reload even if the files haven't changed.
+			}
+			r.check(c)
+		}
+	}
+
+	debounce := time.NewTimer(reloadDebounce)
+	debounce.Stop()
+
+	schedule := time.NewTimer(time.Hour)
+	scheduleNext := func() {
+		schedule.Stop()
+		if next := nextSlot(r.current.ProfileSchedule, time.Now()); !next.IsZero() {
+			schedule.Reset(time.Until(next))
+		}
+	}
+	scheduleNext()
+
+	for {
+		select {
+		case e := <-watcher.Events:
+			name := filepath.Clean(e.Name)
+			if name == filepath.Clean(layers.site) || name == filepath.Clean(layers.local) {
+				debounce.Reset(reloadDebounce)
+			}
+
+		case err := <-watcher.Errors:
+			log.Printf("ERROR: Watching the configuration files: %v", err)
+
+		case <-debounce.C:
+			r.check(c)
+			scheduleNext()
+
+		case <-schedule.C:
+			r.content = nil // The schedule has moved on, reload even if the files haven't changed.
+			r.check(c)
+			scheduleNext()
+		}
+	}
+}
@@ -20,18 +20,39 @@
 package main
 
 import (
-	"github.com/akualab/dmx"
 	_ "github.com/kidoman/embd/host/all"
+	"log"
+	"reflect"
+	"runtime"
+	"strings"
 	"time"
 )
 
 // WeatherMachine holds connections to everything we need to manipulate the installation.
 type WeatherMachine struct {
-	stop      chan bool     // Channel for stopping the control elements of the installation.
-	dmx       *dmx.DMX      // The DMX connection for writting messages to the Smoke machine and lights.
-	config    Configuration // The configuration element for the installation.
-	lastRun   time.Time     // The last time the installation was run.
-	relayCtrl *RelayControl // THe I2C bus
+	stop      chan bool        // Closed to stop the control elements of the current session.
+	attract   chan bool        // Channel for stopping the idle attract mode.
+	lightning chan bool        // Channel for triggering lightning strikes.
+	heartRate int              // The most recent heart rate reading.
+	cueHR     chan int         // Channel for passing heart rate readings to the cue engine.
+	pulseHR   chan int         // Channel for passing heart rate readings to the light pulse.
+	started   time.Time        // The time skin contact started the current session.
+	dmx       *FrameBuffer     // The DMX frame buffer for the Smoke machine and lights.
+	smoke     *SmokeGovernor   // Keeps the smoke machine within its budget.
+	water     *WaterTracker    // Keeps track of the water left for the pump.
+	config    Configuration    // The configuration element for the installation.
+	live      *LiveConfig      // The configuration shared with the running effects.
+	pending   *Configuration   // Configuration changes held back till the current session ends.
+	inSession bool             // Is a session currently running?
+	clearAt   time.Time        // The time the fog from the last run will have cleared.
+	cleared   <-chan time.Time // Fires once the fog has cleared for a session waiting in warmup. nil when not waiting.
+	relayCtrl *RelayControl    // THe I2C bus
+	halted    bool             // Has the installation been stopped by the emergency stop?
+	closed    bool             // Is the venue outside of its opening hours?
+	opening   bool             // Is the venue about to open, with attract mode running?
+	purge     bool             // Did the venue close during an emergency stop, leaving the smoke chamber to purge once reset?
+	lastMsg   HRMsg            // The last message from the heart rate monitor.
+	testing   chan bool        // Channel for stopping a test session. nil when no test session is running.
 }
 
 // ****************************************************************************
@@ -43,11 +64,22 @@ type WeatherMachine struct {
 // stateFunctions are used to manipulate the WeatherMachine through the various states.
 type stateFn func(state *WeatherMachine, msg HRMsg) stateFn
 
+// stateName returns the name of the state function f, such as "idle".
+func stateName(f stateFn) string {
+	name := runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
 // idle is the state the weathermachine enters when sitting alone, with no one interacting with it.
 func idle(state *WeatherMachine, msg HRMsg) (sF stateFn) {
 	if msg.Contact {
+		stopAttract(state.attract)
+		state.started = time.Now()
+		state.inSession = true
+		state.smoke.newSession()
+		state.stop = make(chan bool)
 		enableLight(state.config.S1Beat, state.config, state.dmx)
-		go enablePump(state.config, state.stop, state.relayCtrl)
+		go runCues(sessionCues(state.config), state.live, state.started, state.cueHR, state.stop, state.dmx, state.smoke, state.water, state.relayCtrl)
 
 		return warmup // skin contact has been made, enable light and enter warmup.
 	}
@@ -55,24 +87,36 @@ func idle(state *WeatherMachine, msg HRMsg) (sF stateFn) {
 	return idle // remain idle.
 }
 
-// warmup is the state the weathermachine enters when someone first touches it.
+// warmup is the state the weathermachine enters when someone first touches it. While the fog from
+// the last run is still clearing, warmup waits on cleared and is run again with the latest reading
+// once it has.
 func warmup(state *WeatherMachine, msg HRMsg) stateFn {
 	if msg.Contact && msg.HeartRate > 0 {
 		// Wait for the fog to clear from the last run before running again.
-		d := (int64(state.config.FanDuration) * 1000000) - time.Since(state.lastRun).Nanoseconds()
-		time.Sleep(time.Nanosecond * time.Duration(d))
+		if wait := time.Until(state.clearAt); wait > 0 {
+			if state.cleared == nil {
+				state.cleared = time.After(wait)
+			}
+			return warmup
+		}
+		state.cleared = nil
 
-		go enableLightPulse(state.config, msg.HeartRate, state.stop, state.dmx)
-		go enableSmoke(state.config, state.stop, state.dmx)
-		go enableFan(state.config, state.stop, state.relayCtrl)
+		latestHR(state.pulseHR, msg.HeartRate) // Don't carry a reading over from the last session.
+		go enableLightPulse(state.live, msg.HeartRate, state.pulseHR, state.started, state.stop, state.dmx)
+		go enableLightning(state.live, state.lightning, state.stop, state.dmx)
+		state.cueHR <- msg.HeartRate
+		state.heartRate = msg.HeartRate
 
 		return running // skin contact and heart rate recieved, start the installation.
 	} else if !msg.Contact {
-		state.stop <- true // Pump starts at initial contact. If we lost contact between
-		// then and now we need to shut it down.
-		state.lastRun = time.Now()
+		close(state.stop) // Cues start at initial contact. If we lost contact between
+		// then and now we need to shut them down.
+		state.cleared = nil
+		state.clearAt = time.Now().Add(time.Millisecond * time.Duration(state.config.FanDuration))
+		sessionEnded(state)
 
 		disableLight(state.config, state.dmx)
+		go enableAttract(state.live, state.attract, state.dmx)
 
 		return idle // skin contact lost. Return to idle.
 	}
@@ -83,161 +127,171 @@ func warmup(state *WeatherMachine, msg HRMsg) stateFn {
 // running is the state the weathermachine enters when someone is engaging with it.
 func running(state *WeatherMachine, msg HRMsg) stateFn {
 	if !msg.Contact {
-		state.stop <- true
-		state.stop <- true
-		state.stop <- true
-		state.stop <- true
-		state.lastRun = time.Now()
+		endSession(state)
+		go enableAttract(state.live, state.attract, state.dmx)
 
 		return idle // skin contact lost. Return to idle.
 	}
 
+	if sessionExpired(state.config, state.started) {
+		log.Printf("INFO: Session reached its maximum length")
+		endSession(state)
+
+		return finished // Let the next person have a turn.
+	}
+
+	// Strike lightning when the heart rate spikes, unless a strike is already on its way.
+	if state.config.Lightning.SpikeBPM > 0 && msg.HeartRate-state.heartRate >= state.config.Lightning.SpikeBPM {
+		select {
+		case state.lightning <- true:
+		default:
+		}
+	}
+	state.heartRate = msg.HeartRate
+	select {
+	case state.cueHR <- msg.HeartRate:
+	default: // The cue engine only needs the latest reading, don't hold up the installation.
+	}
+	latestHR(state.pulseHR, msg.HeartRate)
+
 	return running // Keep the installation running.
 }
 
+// finished is the state the weathermachine enters when a session ends while someone is still touching
+// it. Nothing runs till they let go.
+func finished(state *WeatherMachine, msg HRMsg) stateFn {
+	if !msg.Contact {
+		go enableAttract(state.live, state.attract, state.dmx)
+
+		return idle // skin contact lost. Return to idle.
+	}
+
+	return finished
+}
+
+// endSession stops the control elements of a running session, without waiting for them to finish. The
+// fog clears using the FanDuration of the session that made it, even if the configuration changes
+// before the next session.
+func endSession(state *WeatherMachine) {
+	close(state.stop)
+	state.clearAt = time.Now().Add(time.Millisecond * time.Duration(state.config.FanDuration))
+	sessionEnded(state)
+}
+
 // ****************************************************************************
 // ****************************************************************************
 // Functions for manipulating the physical installation; lights, smoke and fan.
 // ****************************************************************************
 // ****************************************************************************
 
-// enableLight turns on the light via the supplied DMX connection 'dmx' with the supplied colour 'l'.
-func enableLight(l LightColour, c Configuration, dmx *dmx.DMX) {
+// enableLight turns on the light via the supplied DMX frame buffer 'dmx' with the supplied colour 'l'.
+func enableLight(l LightColour, c Configuration, dmx *FrameBuffer) {
 	dmx.SetChannel(4, byte(l.Red))
 	dmx.SetChannel(5, byte(l.Green))
 	dmx.SetChannel(6, byte(l.Blue))
 	dmx.SetChannel(7, byte(l.Amber))
 	dmx.SetChannel(8, byte(l.Dimmer))
-	dmx.Render()
 }
 
-// disableLight turns off the light via the supplied DMX connection 'dmx'.
-func disableLight(c Configuration, dmx *dmx.DMX) {
+// disableLight turns off the light via the supplied DMX frame buffer 'dmx'.
+func disableLight(c Configuration, dmx *FrameBuffer) {
 	dmx.SetChannel(4, 0)
 	dmx.SetChannel(5, 0)
 	dmx.SetChannel(6, 0)
 	dmx.SetChannel(7, 0)
 	dmx.SetChannel(8, 0)
-	dmx.Render()
 }
 
-// pulseLight pulses the light for a fixed duration.
-func pulseLight(c Configuration, dmx *dmx.DMX) {
-	enableLight(c.S1Beat, c, dmx)
-	time.Sleep(time.Millisecond * time.Duration(c.S1Duration))
-	disableLight(c, dmx)
-
-	time.Sleep(time.Millisecond * time.Duration(c.S1Pause))
-
-	enableLight(c.S2Beat, c, dmx)
-	time.Sleep(time.Millisecond * time.Duration(c.S2Duration))
-	disableLight(c, dmx)
+// overlayLight layers the colour 'l' over the light channels of the frame buffer 'dmx', on the overlay
+// layer.
+func overlayLight(layer int, l LightColour, dmx *FrameBuffer) {
+	dmx.SetOverlay(layer, 4, byte(l.Red))
+	dmx.SetOverlay(layer, 5, byte(l.Green))
+	dmx.SetOverlay(layer, 6, byte(l.Blue))
+	dmx.SetOverlay(layer, 7, byte(l.Amber))
+	dmx.SetOverlay(layer, 8, byte(l.Dimmer))
 }
 
-// enableLightPulse starts the light pulsing by the frequency defined by hr. The light remains
-// pulsing till being notified to stop on d.
-func enableLightPulse(c Configuration, hr int, d chan bool, dmx *dmx.DMX) {
-	// Perform the first heart beat straight away.
-	pulseLight(c, dmx)
-
-	dt := int((60000.0 / float32(hr)) * c.BeatRate)
-	ticker := time.NewTicker(time.Millisecond * time.Duration(dt)).C
-
-	// Sharp fixed length, pulse of light with variable off gap depending on HR.
-	for {
-		select {
-		case <-ticker:
-			pulseLight(c, dmx)
-
-		case <-d:
-			return
-		}
+// clearOverlayLight reveals whatever the light is doing underneath the overlay layer.
+func clearOverlayLight(layer int, dmx *FrameBuffer) {
+	for ch := 4; ch <= 8; ch++ {
+		dmx.ClearOverlay(layer, ch)
 	}
 }
 
-// pulsePump runs the pump for the duration specified in the configuration.
-func pulsePump(c Configuration, relayCtrl *RelayControl) {
-	relayCtrl.regData &= ^(byte(0x1) << c.I2CPinPump)
-	relayCtrl.bus.WriteByteToReg(relayCtrl.address, relayCtrl.mode, relayCtrl.regData)
+// pulseLight pulses the light once for each of the S1 and S2 beats, shaping each beat with its
+// envelope, colouring it for the heart rate hr and dimming it for the phase ph.
+func pulseLight(c Configuration, hr int, ph Phase, dmx *FrameBuffer) {
+	s1, s2 := beatColours(c, hr)
+	s1.Dimmer = clampChannel(float64(s1.Dimmer) * float64(ph.LightScale))
+	s2.Dimmer = clampChannel(float64(s2.Dimmer) * float64(ph.LightScale))
 
-	time.Sleep(time.Millisecond * time.Duration(c.PumpDuration))
+	events.publish("beat", map[string]interface{}{"Beat": "S1", "HeartRate": hr, "Colour": s1})
+	envelopeLight(s1, c.S1Envelope, c.S1Duration, c, dmx)
 
-	relayCtrl.regData |= (byte(0x1) << c.I2CPinPump)
-	relayCtrl.bus.WriteByteToReg(relayCtrl.address, relayCtrl.mode, relayCtrl.regData)
-}
-
-// enablePump switches the relay on for the water pump after DeltaTPump milliseconds have expired
-// in the configuration. Pump remains on till being notified to stop on d.
-func enablePump(c Configuration, d chan bool, relayCtrl *RelayControl) {
-	dt := time.NewTimer(time.Millisecond * time.Duration(c.DeltaTPump)).C
-	var ticker <-chan time.Time
+	time.Sleep(time.Millisecond * time.Duration(c.S1Pause))
 
-	for {
-		select {
-		case <-dt:
-			pulsePump(c, relayCtrl)
-			ticker = time.NewTicker(time.Millisecond * time.Duration(c.PumpInterval)).C
+	events.publish("beat", map[string]interface{}{"Beat": "S2", "HeartRate": hr, "Colour": s2})
+	envelopeLight(s2, c.S2Envelope, c.S2Duration, c, dmx)
+}
 
-		case <-ticker:
-			pulsePump(c, relayCtrl)
+// latestHR replaces any unread heart rate waiting on hrs with hr, without ever blocking. hrs must be
+// buffered.
+func latestHR(hrs chan int, hr int) {
+	select {
+	case <-hrs:
+	default:
+	}
 
-		case <-d:
-			return
-		}
+	select {
+	case hrs <- hr:
+	default:
 	}
 }
 
-// enableFan switches the relay on for the fan after DeltaTFan milliseconds have expired
-// in the configuration. Fan remains on till being notified to stop on d.
-func enableFan(c Configuration, d chan bool, relayCtrl *RelayControl) {
-	dt := time.NewTimer(time.Millisecond * time.Duration(c.DeltaTFan)).C
+// enableLightPulse starts the light pulsing by the frequency defined by hr, for a session that started
+// at the time started. Each beat uses the latest live configuration and the latest heart rate received
+// on hrs for its colour and timing. The light remains pulsing till being notified to stop on d.
+func enableLightPulse(live *LiveConfig, hr int, hrs chan int, started time.Time, d chan bool, dmx *FrameBuffer) {
+	// Perform the first heart beat straight away.
+	beat := time.Now()
+	c := live.get()
+	pulseLight(c, hr, phaseAt(c.Phases, time.Since(started)), dmx)
+
+	// Shaped pulse of light with variable off gap depending on HR.
+	dt := time.Millisecond * time.Duration((60000.0/float32(hr))*c.BeatRate)
+	timer := time.NewTimer(time.Until(beat.Add(dt)))
+	defer timer.Stop()
 
 	for {
 		select {
-		case <-dt:
-			relayCtrl.regData &= ^(byte(0x1) << c.I2CPinFan)
-			relayCtrl.bus.WriteByteToReg(relayCtrl.address, relayCtrl.mode, relayCtrl.regData)
+		case <-timer.C:
+			beat = beat.Add(dt)
+			c = live.get()
+			pulseLight(c, hr, phaseAt(c.Phases, time.Since(started)), dmx)
+
+			dt = time.Millisecond * time.Duration((60000.0/float32(hr))*c.BeatRate)
+			timer.Reset(time.Until(beat.Add(dt)))
+
+		case h := <-hrs:
+			if h > 0 {
+				hr = h
+			}
 
 		case <-d:
-			// Wait for the fan duration to clear the smoke chamber.
-			ft := time.NewTimer(time.Millisecond * time.Duration(c.FanDuration)).C
-			<-ft
-			relayCtrl.regData |= (byte(0x1) << c.I2CPinFan)
-			relayCtrl.bus.WriteByteToReg(relayCtrl.address, relayCtrl.mode, relayCtrl.regData)
 			return
 		}
 	}
 }
 
-// puffSmoke enables the smoke machine via the supplied DMX connection 'dmx' for a period of
-// time and intentsity supplied in configuration.
-func puffSmoke(c Configuration, dmx *dmx.DMX) {
-	dmx.SetChannel(1, byte(c.SmokeVolume))
-	dmx.Render()
-
-	time.Sleep(time.Millisecond * time.Duration(c.SmokeDuration))
-
-	dmx.SetChannel(1, 0)
-	dmx.Render()
-}
-
-// enableSmoke enages the DMX smoke machine by the SmokeVolume amount in the configuration.
-// Smoke Machine remains on till being notified to stop on d.
-func enableSmoke(c Configuration, d chan bool, dmx *dmx.DMX) {
-	dt := time.NewTimer(time.Millisecond * time.Duration(c.DeltaTSmoke)).C
-	var ticker <-chan time.Time
+// lightLook shows the colour 'l' over the top of the heartbeat for duration milliseconds. Lightning
+// still strikes over the top of a look, and ending a look never cuts a strike short. A look that starts
+// before this one ends takes over, and isn't cleared when this one ends.
+func lightLook(l LightColour, duration int, dmx *FrameBuffer) {
+	token := dmx.ClaimOverlay(lookLayer)
+	overlayLight(lookLayer, l, dmx)
 
-	for {
-		select {
-		case <-dt:
-			puffSmoke(c, dmx)
-			ticker = time.NewTicker(time.Millisecond * time.Duration(c.SmokeInterval)).C
+	time.Sleep(time.Millisecond * time.Duration(duration))
 
-		case <-ticker:
-			puffSmoke(c, dmx)
-
-		case <-d:
-			return
-		}
-	}
+	dmx.ReleaseOverlay(lookLayer, token, 4, 5, 6, 7, 8)
 }
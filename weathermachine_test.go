@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) Clinton Freeman 2016
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Light pulse", func() {
+	blue := LightColour{0, 0, 255, 0, 100}
+	red := LightColour{255, 0, 0, 0, 250}
+
+	It("should colour each beat for the latest heart rate", func() {
+		c := defaultConfiguration()
+		c.ColourMap = []ColourStop{{60, blue}, {120, red}}
+		c.S1Envelope, c.S2Envelope = Envelope{}, Envelope{}
+		c.S1Duration, c.S2Duration, c.S1Pause = 1, 1, 1
+		c.BeatRate = 0.01
+
+		sub := events.subscribe()
+		defer events.unsubscribe(sub)
+
+		hrs := make(chan int, 1)
+		d := make(chan bool)
+		go enableLightPulse(NewLiveConfig(c), 60, hrs, time.Now(), d, NewFrameBuffer(nullOutput{}, 200))
+		defer func() { d <- true }()
+
+		beat := func() (int, LightColour) {
+			for e := range sub {
+				if b, ok := e.Data.(map[string]interface{}); ok && e.Type == "beat" && b["Beat"] == "S1" {
+					return b["HeartRate"].(int), b["Colour"].(LightColour)
+				}
+			}
+			return 0, LightColour{}
+		}
+
+		hr, colour := beat()
+		Ω(hr).Should(Equal(60))
+		Ω(colour).Should(Equal(blue))
+
+		latestHR(hrs, 120)
+		Eventually(func() LightColour { _, colour := beat(); return colour }).Should(Equal(red))
+	})
+
+	It("should only keep the latest unread heart rate", func() {
+		hrs := make(chan int, 1)
+		latestHR(hrs, 70)
+		latestHR(hrs, 90)
+
+		Ω(hrs).Should(HaveLen(1))
+		Ω(<-hrs).Should(Equal(90))
+	})
+
+	It("should leave a look showing when an earlier look ends", func() {
+		fb := NewFrameBuffer(nullOutput{}, 40)
+		red4 := func() int {
+			fb.mu.Lock()
+			defer fb.mu.Unlock()
+			if !fb.overlaid[lookLayer][3] {
+				return -1
+			}
+			return int(fb.overlay[lookLayer][3])
+		}
+
+		go lightLook(blue, 30, fb)
+		Eventually(red4).Should(Equal(0))
+		go lightLook(red, 150, fb)
+		Eventually(red4).Should(Equal(255))
+
+		// The blue look ends while the red one is still showing.
+		Consistently(red4, "60ms", "5ms").Should(Equal(255))
+		Eventually(red4).Should(Equal(-1))
+	})
+})
+
+var _ = Describe("Warmup", func() {
+	It("should wait for the fog to clear without holding up the installation", func() {
+		c := defaultConfiguration()
+		state := WeatherMachine{attract: make(chan bool), lightning: make(chan bool, 1), cueHR: make(chan int, 1),
+			pulseHR: make(chan int, 1), config: c, live: NewLiveConfig(c), dmx: NewFrameBuffer(nullOutput{}, 40),
+			stop: make(chan bool), clearAt: time.Now().Add(50 * time.Millisecond)}
+
+		start := time.Now()
+		update := warmup(&state, HRMsg{70, true})
+		Ω(time.Since(start)).Should(BeNumerically("<", 10*time.Millisecond))
+		Ω(stateName(update)).Should(Equal("warmup"))
+		Ω(state.cleared).ShouldNot(BeNil())
+
+		Eventually(state.cleared).Should(Receive())
+		state.cleared = nil
+		update = update(&state, HRMsg{70, true})
+		Ω(stateName(update)).Should(Equal("running"))
+
+		close(state.stop)
+	})
+
+	It("should stop waiting for the fog when contact is lost", func() {
+		c := defaultConfiguration()
+		state := WeatherMachine{attract: make(chan bool), config: c, live: NewLiveConfig(c),
+			dmx: NewFrameBuffer(nullOutput{}, 40), smoke: NewSmokeGovernor(c.SmokeBudget), stop: make(chan bool),
+			clearAt: time.Now().Add(time.Minute)}
+
+		warmup(&state, HRMsg{70, true})
+		update := warmup(&state, HRMsg{0, false})
+
+		Ω(stateName(update)).Should(Equal("idle"))
+		Ω(state.cleared).Should(BeNil())
+		Ω(state.stop).Should(BeClosed())
+		stopAttract(state.attract)
+	})
+})